@@ -0,0 +1,92 @@
+package workflow_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dafanshu/mini-flow/flow"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResume(t *testing.T) {
+	fileStore, err := flow.NewFileCheckpointStore(t.TempDir())
+	assert.Equal(t, nil, err)
+
+	for _, store := range []flow.CheckpointStore{flow.NewMemoryCheckpointStore(), fileStore} {
+		charges, down := 0, true
+		workflow := new(flow.Workflow)
+		dag := workflow.NewDag()
+		dag.Node("charge").Modify(func(data []byte) ([]byte, error) {
+			charges++
+			return []byte(`{"receipt":"r-1"}`), nil
+		}).Out("receipt")
+		dag.Node("ship").Modify(func(data []byte) ([]byte, error) {
+			if down {
+				return nil, errors.New("backend down")
+			}
+			return data, nil
+		}).In("receipt").Out("receipt")
+		dag.Edge("charge", "ship")
+
+		executor := flow.FlowExecutor{Flow: workflow, Checkpoints: store}
+		result, err := executor.ExecuteRun("order-1", []byte(`{}`))
+		assert.EqualError(t, err, "[error: Failed at modifier, backend down,]")
+		assert.Equal(t, "order-1", result.RunId)
+
+		down = false
+		result, err = executor.Resume("order-1")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, `{"receipt":"r-1"}`, string(result.Output))
+		assert.Equal(t, 1, charges)
+
+		_, err = executor.Resume("order-1")
+		assert.Equal(t, flow.ErrUnknownRun, err)
+	}
+}
+
+func TestResumeCompensated(t *testing.T) {
+	charges, refunds, down := 0, 0, true
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("charge").Modify(func(data []byte) ([]byte, error) {
+		charges++
+		return []byte(`{"receipt":"r-1"}`), nil
+	}).Out("receipt").CompensateModify(func(data []byte) ([]byte, error) {
+		refunds++
+		return data, nil
+	})
+	dag.Node("ship").Modify(func(data []byte) ([]byte, error) {
+		if down {
+			return nil, errors.New("backend down")
+		}
+		return data, nil
+	}).In("receipt").Out("receipt")
+	dag.Edge("charge", "ship")
+
+	executor := flow.FlowExecutor{Flow: workflow, Checkpoints: flow.NewMemoryCheckpointStore()}
+	_, err := executor.ExecuteRun("order-1", []byte(`{}`))
+	assert.Contains(t, err.Error(), "compensated nodes: [charge]")
+
+	down = false
+	result, err := executor.Resume("order-1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"receipt":"r-1"}`, string(result.Output))
+	assert.Equal(t, 2, charges)
+	assert.Equal(t, 1, refunds)
+}
+
+func TestFileCheckpointStorePaths(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "checkpoints")
+	store, err := flow.NewFileCheckpointStore(dir)
+	assert.Equal(t, nil, err)
+
+	assert.Equal(t, nil, store.SaveRun("../escaped", []byte(`{}`)))
+	entries, _ := os.ReadDir(root)
+	assert.Equal(t, 1, len(entries))
+	request, _, err := store.Load("../escaped")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{}`, string(request))
+}
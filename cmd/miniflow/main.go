@@ -0,0 +1,64 @@
+// Command miniflow runs the sample workflow, or with -dry-run prints its
+// execution plan without invoking any operation
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/dafanshu/mini-flow/flow"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "print the execution plan instead of running the workflow")
+	request := flag.String("request", `{"kk":"aaaaaaa","foo":"foooo","bar":"bar"}`, "JSON request of the run")
+	flag.Parse()
+
+	workflow := sampleFlow()
+	if *dryRun {
+		plan, err := workflow.Plan()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Println(plan)
+		return
+	}
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	result, err := executor.ExecuteFlow([]byte(*request))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	fmt.Println(string(result))
+}
+
+// sampleFlow builds a node turning the request into a sql query and posting
+// it to a local query service
+func sampleFlow() *flow.Workflow {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+
+	method := flow.Header("method", "POST")
+	param := flow.Query("method", "GET")
+
+	dag.Node("node6").Modify(func(data []byte) ([]byte, error) {
+		param := make(map[string]string)
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &param); err != nil {
+				return nil, err
+			}
+		}
+		dataMap := make(map[string]interface{})
+		dataMap["language"] = "sql"
+		dataMap["sql"] = "SELECT * FROM log_his limit 0,1"
+		dataMap["param"] = param
+		dataMap["dsId"] = "1"
+		return json.Marshal(dataMap)
+	}).In("foo", "bar").Out("stdout").Request("http://localhost:8084", method, param)
+
+	return workflow
+}
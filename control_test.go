@@ -0,0 +1,340 @@
+package workflow_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/dafanshu/mini-flow/flow"
+	"github.com/dafanshu/simplejson"
+	"github.com/stretchr/testify/assert"
+)
+
+func echo(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func TestParseCondition(t *testing.T) {
+	data, _ := simplejson.NewJson([]byte(`{"amount":1500,"status":"done","user":{"vip":true},"retry":0}`))
+	cases := map[string]bool{
+		`amount > 1000`:                      true,
+		`amount <= 1000`:                     false,
+		`status == "done" && !retry`:         true,
+		`status != 'done' || user.vip`:       true,
+		`(amount > 2000 || retry) && status`: false,
+		`missing == null`:                    true,
+	}
+	for expr, expected := range cases {
+		cond, err := flow.ParseCondition(expr)
+		assert.Equal(t, nil, err, expr)
+		assert.Equal(t, expected, cond(data), expr)
+	}
+
+	_, err := flow.ParseCondition(`amount >`)
+	assert.EqualError(t, err, `condition "amount >": unexpected end`)
+}
+
+func TestConditionalEdges(t *testing.T) {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+
+	dag.Node("order").Modify(echo).In("amount").Out("amount")
+	dag.Node("fraud").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"fraud":"checked"}`), nil
+	}).Out("fraud")
+	dag.Node("report").Modify(echo).In("fraud").Out("fraud")
+	dag.Node("notify").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"notified":true}`), nil
+	}).Out("notified")
+
+	dag.EdgeWhen("order", "fraud", "amount > 1000")
+	dag.EdgeIf("order", "notify", func(out *simplejson.Json) bool {
+		_, ok := out.CheckGet("amount")
+		return ok
+	})
+	dag.Edge("fraud", "report")
+	workflow.Outputs("notified")
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	result, err := executor.Execute([]byte(`{"amount":500}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"notified":true}`, string(result.Output))
+	assert.Equal(t, []string{"fraud", "report"}, result.Skipped)
+
+	result, err = executor.Execute([]byte(`{"amount":5000}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{}, result.Skipped)
+}
+
+func TestSwitch(t *testing.T) {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+
+	paidBy := func(method string) flow.Modifier {
+		return func(data []byte) ([]byte, error) {
+			return []byte(`{"paid_by":"` + method + `"}`), nil
+		}
+	}
+	dag.Node("route").In("kind").SwitchOn("kind").
+		Case("card", "card").
+		Case("bank", "bank").
+		Default("manual")
+	dag.Node("card").Modify(paidBy("card")).Out("paid_by")
+	dag.Node("bank").Modify(paidBy("bank")).Out("paid_by")
+	dag.Node("manual").Modify(paidBy("manual")).Out("paid_by")
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	result, err := executor.Execute([]byte(`{"kind":"bank"}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"paid_by":"bank"}`, string(result.Output))
+	assert.Equal(t, []string{"card", "manual"}, result.Skipped)
+	assert.Equal(t, map[string]string{"route": "bank"}, result.Branches)
+
+	result, err = executor.Execute([]byte(`{"kind":"cash"}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"paid_by":"manual"}`, string(result.Output))
+}
+
+func TestForEach(t *testing.T) {
+	double := func(data []byte) ([]byte, error) {
+		item, _ := simplejson.NewJson(data)
+		id, err := item.Int()
+		if err != nil {
+			return nil, err
+		}
+		return []byte(fmt.Sprintf(`{"id":%d}`, id*2)), nil
+	}
+
+	workflow := new(flow.Workflow)
+	workflow.NewDag().Node("orders").In("ids").ForEach("ids", flow.Concurrency(2)).
+		Modify(double).Out("orders")
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	result, err := executor.ExecuteFlow([]byte(`{"ids":[1,2,3,4,5]}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"orders":[{"id":2},{"id":4},{"id":6},{"id":8},{"id":10}]}`, string(result))
+
+	_, err = executor.ExecuteFlow([]byte(`{"ids":[1,"x",3]}`))
+	assert.Contains(t, err.Error(), "foreach node orders: element 1")
+
+	workflow = new(flow.Workflow)
+	workflow.NewDag().Node("orders").In("ids").ForEach("ids", flow.CollectErrors("failed")).
+		Modify(double).Out("orders")
+
+	executor = flow.FlowExecutor{Flow: workflow}
+	result, err = executor.ExecuteFlow([]byte(`{"ids":[1,"x",3]}`))
+	assert.Equal(t, nil, err)
+	output, _ := simplejson.NewJson(result)
+	orders, _ := output.Get("orders").MarshalJSON()
+	assert.Equal(t, `[{"id":2},null,{"id":6}]`, string(orders))
+	index, _ := output.Get("failed").GetIndex(0).Get("index").Int()
+	assert.Equal(t, 1, index)
+
+	// collected errors do not hide the node itself timing out or being cancelled
+	slow := func(data []byte) ([]byte, error) {
+		time.Sleep(200 * time.Millisecond)
+		return data, nil
+	}
+	workflow = new(flow.Workflow)
+	workflow.NewDag().Node("orders").In("ids").ForEach("ids", flow.CollectErrors("failed")).
+		Modify(slow).Out("orders").Timeout(50 * time.Millisecond)
+
+	executor = flow.FlowExecutor{Flow: workflow}
+	_, err = executor.ExecuteFlow([]byte(`{"ids":[1,2]}`))
+	var timeoutErr *flow.TimeoutError
+	if assert.True(t, errors.As(err, &timeoutErr)) {
+		assert.Equal(t, "orders", timeoutErr.NodeId)
+	}
+
+	workflow = new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("orders").In("ids").ForEach("ids", flow.CollectErrors("failed")).
+		Modify(slow).Out("orders")
+	dag.Node("broken").Modify(func(data []byte) ([]byte, error) {
+		return nil, errors.New("backend down")
+	})
+
+	executor = flow.FlowExecutor{Flow: workflow, FailureMode: flow.FailFast}
+	_, err = executor.ExecuteFlow([]byte(`{"ids":[1,2]}`))
+	assert.Contains(t, err.Error(), "cancelled nodes: [orders]")
+}
+
+func TestSubFlow(t *testing.T) {
+	child := new(flow.Workflow)
+	childDag := child.NewDag()
+	childDag.Node("lookup").Modify(func(data []byte) ([]byte, error) {
+		request, _ := simplejson.NewJson(data)
+		id, _ := request.Get("user_id").String()
+		requestId, _ := request.Get("request-id").String()
+		profile := map[string]string{"id": id, "trace": requestId}
+		result := simplejson.New()
+		result.Set("profile", profile)
+		return result.MarshalJSON()
+	}).In("user_id", "request-id").Out("profile")
+	child.Outputs("profile")
+
+	parent := new(flow.Workflow)
+	dag := parent.NewDag()
+	dag.Node("enrich").In("user_id").SubFlow(child).Out("profile")
+	dag.Node("greet").Modify(func(data []byte) ([]byte, error) {
+		request, _ := simplejson.NewJson(data)
+		id, _ := request.GetPath("profile", "id").String()
+		return []byte(`{"greeting":"hello ` + id + `"}`), nil
+	}).In("profile").Out("greeting")
+	dag.Edge("enrich", "greet")
+	parent.Outputs("profile", "greeting")
+
+	executor := flow.FlowExecutor{Flow: parent}
+	result, err := executor.ExecuteFlow([]byte(`{"user_id":"u1","request-id":"r1"}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"greeting":"hello u1","profile":{"id":"u1","trace":"r1"}}`, string(result))
+
+	partial := new(flow.Workflow)
+	partialDag := partial.NewDag()
+	partialDag.Node("good").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"x":1}`), nil
+	}).Out("x")
+	partialDag.Node("bad").Modify(func(data []byte) ([]byte, error) {
+		return nil, errors.New("child down")
+	}).ContinueOnError()
+
+	parent = new(flow.Workflow)
+	parent.NewDag().Node("embed").SubFlow(partial).Out("x")
+	executor = flow.FlowExecutor{Flow: parent}
+	_, err = executor.ExecuteFlow([]byte(`{}`))
+	var partialErr *flow.PartialError
+	assert.True(t, errors.As(err, &partialErr))
+	assert.Equal(t, "bad", partialErr.Errors[0].NodeId)
+
+	racing := new(flow.Workflow)
+	racingDag := racing.NewDag()
+	racingDag.Node("broken").Modify(func(data []byte) ([]byte, error) {
+		return nil, errors.New("child down")
+	})
+	racingDag.Node("slow").Modify(func(data []byte) ([]byte, error) {
+		time.Sleep(time.Second)
+		return data, nil
+	})
+	parent = new(flow.Workflow)
+	parent.NewDag().Node("embed").SubFlow(racing)
+	executor = flow.FlowExecutor{Flow: parent, FailureMode: flow.FailFast}
+	start := time.Now()
+	_, err = executor.ExecuteFlow([]byte(`{}`))
+	assert.Contains(t, err.Error(), "cancelled nodes: [slow]")
+	assert.True(t, time.Since(start) < time.Second)
+
+	self := new(flow.Workflow)
+	self.NewDag().Node("loop").SubFlow(self)
+	_, err = self.Compile()
+	assert.EqualError(t, err, "subflow node loop: workflow embeds itself as a sub workflow")
+}
+
+func TestRepeatUntil(t *testing.T) {
+	polls := 0
+	poll := func(data []byte) ([]byte, error) {
+		polls++
+		status := "running"
+		if polls >= 3 {
+			status = "done"
+		}
+		return []byte(fmt.Sprintf(`{"status":%q,"polls":%d}`, status, polls)), nil
+	}
+
+	workflow := new(flow.Workflow)
+	workflow.NewDag().Node("poll").Modify(poll).
+		RepeatUntilExpr(`status == "done"`, flow.Interval(time.Millisecond)).Out("status", "polls")
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	result, err := executor.ExecuteFlow([]byte(`{}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"polls":3,"status":"done"}`, string(result))
+
+	polls = 0
+	workflow = new(flow.Workflow)
+	workflow.NewDag().Node("poll").Modify(poll).
+		RepeatUntil(func(out *simplejson.Json) bool {
+			status, _ := out.Get("status").String()
+			return status == "done"
+		}, flow.MaxIterations(2)).Out("status")
+
+	executor = flow.FlowExecutor{Flow: workflow}
+	_, err = executor.ExecuteFlow([]byte(`{}`))
+	assert.EqualError(t, err, "[loop node poll: condition not met after 2 iterations,]")
+}
+
+func TestJoinAny(t *testing.T) {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+
+	provider := func(name string, delay time.Duration) flow.Modifier {
+		return func(data []byte) ([]byte, error) {
+			time.Sleep(delay)
+			return []byte(`{"quote":"` + name + `"}`), nil
+		}
+	}
+	dag.Node("slow").Modify(provider("slow", time.Second)).Out("quote")
+	dag.Node("fast").Modify(provider("fast", 0)).Out("quote")
+	dag.Node("pick").Modify(echo).In("quote").Out("quote").Join(flow.JoinAny)
+	dag.Edge("slow", "pick")
+	dag.Edge("fast", "pick")
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	start := time.Now()
+	result, err := executor.Execute([]byte(`{}`))
+	assert.Equal(t, nil, err)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, `{"quote":"fast"}`, string(result.Output))
+	assert.Equal(t, []string{"slow"}, result.Cancelled)
+
+	down := func(name string) flow.Modifier {
+		return func(data []byte) ([]byte, error) {
+			return nil, errors.New(name + " down")
+		}
+	}
+	workflow = new(flow.Workflow)
+	dag = workflow.NewDag()
+	dag.Node("p1").Modify(down("p1")).Out("quote")
+	dag.Node("p2").Modify(provider("p2", 50*time.Millisecond)).Out("quote")
+	dag.Node("use").Modify(echo).In("quote").Out("quote").Join(flow.JoinAny)
+	dag.Edge("p1", "use")
+	dag.Edge("p2", "use")
+	executor = flow.FlowExecutor{Flow: workflow}
+	result, err = executor.Execute([]byte(`{}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"quote":"p2"}`, string(result.Output))
+
+	workflow = new(flow.Workflow)
+	dag = workflow.NewDag()
+	dag.Node("p1").Modify(down("p1")).Out("quote")
+	dag.Node("p2").Modify(down("p2")).Out("quote")
+	dag.Node("use").Modify(echo).In("quote").Out("quote").Join(flow.JoinAny)
+	dag.Edge("p1", "use")
+	dag.Edge("p2", "use")
+	executor = flow.FlowExecutor{Flow: workflow}
+	_, err = executor.Execute([]byte(`{}`))
+	assert.Contains(t, err.Error(), "down")
+
+	// a racer failing before the join misses its quorum fails the run
+	workflow = new(flow.Workflow)
+	dag = workflow.NewDag()
+	dag.Node("p1").Modify(down("p1")).Out("quote")
+	dag.Node("p2").Modify(provider("p2", 50*time.Millisecond)).Out("quote")
+	dag.Node("use").Modify(echo).In("quote").Out("quote").Join(flow.JoinAny)
+	dag.Edge("p1", "use")
+	dag.EdgeWhen("p2", "use", `quote == "p1"`)
+	executor = flow.FlowExecutor{Flow: workflow}
+	_, err = executor.Execute([]byte(`{}`))
+	var nodeErr *flow.NodeError
+	if assert.True(t, errors.As(err, &nodeErr)) {
+		assert.Equal(t, "p1", nodeErr.NodeId)
+	}
+
+	workflow = new(flow.Workflow)
+	dag = workflow.NewDag()
+	dag.Node("a").Modify(echo)
+	dag.Node("join").Modify(echo).Join(flow.JoinQuorum(2))
+	dag.Edge("a", "join")
+	_, err = workflow.Compile()
+	assert.EqualError(t, err, "node join: quorum 2 exceeds its 1 predecessors")
+}
@@ -0,0 +1,270 @@
+package workflow_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dafanshu/mini-flow/flow"
+	"github.com/dafanshu/simplejson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailFast(t *testing.T) {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("broken").Modify(func(data []byte) ([]byte, error) {
+		return nil, errors.New("backend down")
+	})
+	dag.Node("slow").Modify(func(data []byte) ([]byte, error) {
+		time.Sleep(time.Second)
+		return data, nil
+	})
+
+	executor := flow.FlowExecutor{Flow: workflow, FailureMode: flow.FailFast}
+	start := time.Now()
+	_, err := executor.ExecuteFlow([]byte(`{}`))
+	assert.True(t, time.Since(start) < time.Second)
+
+	var failFastErr *flow.FailFastError
+	assert.True(t, errors.As(err, &failFastErr))
+	assert.Equal(t, []string{"slow"}, failFastErr.Cancelled)
+	assert.Equal(t, "[error: Failed at modifier, backend down,], cancelled nodes: [slow]", err.Error())
+}
+
+func TestContinueOnError(t *testing.T) {
+	fail := func(data []byte) ([]byte, error) {
+		return nil, errors.New("widget backend down")
+	}
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("news").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"news":["a","b"]}`), nil
+	}).Out("news")
+	dag.Node("weather").Modify(fail).Out("weather").ContinueOnError()
+	dag.Node("forecast").Modify(echo).In("weather").Out("forecast")
+	dag.Node("stocks").Modify(fail).Out("stocks").Fallback([]byte(`{"stocks":[]}`))
+	dag.Edge("weather", "forecast")
+	workflow.Outputs("news", "forecast", "stocks")
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	result, err := executor.Execute([]byte(`{}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"news":["a","b"],"stocks":[]}`, string(result.Output))
+	assert.Equal(t, []string{"forecast"}, result.Skipped)
+	assert.Equal(t, 2, len(result.Errors))
+
+	output, err := executor.ExecuteFlow([]byte(`{}`))
+	assert.Equal(t, `{"news":["a","b"],"stocks":[]}`, string(output))
+	var partialErr *flow.PartialError
+	assert.True(t, errors.As(err, &partialErr))
+	assert.Equal(t, "weather", partialErr.Errors[0].NodeId)
+	assert.Equal(t, "stocks", partialErr.Errors[1].NodeId)
+
+	workflow = new(flow.Workflow)
+	dag = workflow.NewDag()
+	dag.Node("a").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{}`), nil
+	}).Out("x")
+	dag.Node("b").Modify(fail).ContinueOnError()
+	workflow.Outputs("x")
+	executor = flow.FlowExecutor{Flow: workflow}
+	_, err = executor.Execute([]byte(`{}`))
+	assert.EqualError(t, err, `workflow output "x" was never produced`)
+}
+
+func TestCompensate(t *testing.T) {
+	undone := make([]string, 0)
+	undo := func(name string) flow.Modifier {
+		return func(data []byte) ([]byte, error) {
+			undone = append(undone, name+":"+string(data))
+			if name == "car" {
+				return nil, errors.New("cannot cancel car")
+			}
+			return data, nil
+		}
+	}
+	book := func(key string) flow.Modifier {
+		return func(data []byte) ([]byte, error) {
+			return []byte(`{"` + key + `":"booked"}`), nil
+		}
+	}
+
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("hotel").Modify(book("hotel")).In("trip").Out("hotel").CompensateModify(undo("hotel"))
+	dag.Node("car").Modify(book("car")).In("hotel").Out("car").CompensateModify(undo("car"))
+	dag.Node("flight").Modify(book("flight")).In("car").Out("flight").CompensateModify(undo("flight"))
+	dag.Node("charge").Modify(func(data []byte) ([]byte, error) {
+		return nil, errors.New("card declined")
+	}).In("flight")
+	dag.Edge("hotel", "car")
+	dag.Edge("car", "flight")
+	dag.Edge("flight", "charge")
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	_, err := executor.ExecuteFlow([]byte(`{"trip":"t1"}`))
+
+	var compensationErr *flow.CompensationError
+	assert.True(t, errors.As(err, &compensationErr))
+	assert.Equal(t, "[error: Failed at modifier, card declined,]", compensationErr.Cause.Error())
+	assert.Equal(t, []string{
+		`flight:{"car":"booked","flight":"booked"}`,
+		`car:{"car":"booked","hotel":"booked"}`,
+		`hotel:{"hotel":"booked","trip":"t1"}`,
+	}, undone)
+	assert.Equal(t, 3, len(compensationErr.Compensations))
+	assert.Contains(t, err.Error(), "compensated nodes: [flight,hotel]")
+	assert.Contains(t, err.Error(), "failed compensations: [car: error: Failed at modifier, cannot cancel car]")
+
+	refunds := 0
+	workflow = new(flow.Workflow)
+	workflow.NewDag().Node("charge").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{}`), nil
+	}).Out("receipt").CompensateModify(func(data []byte) ([]byte, error) {
+		refunds++
+		return data, nil
+	})
+	workflow.Outputs("receipt")
+	executor = flow.FlowExecutor{Flow: workflow}
+	_, err = executor.ExecuteFlow([]byte(`{}`))
+	assert.EqualError(t, err, `workflow output "receipt" was never produced, compensated nodes: [charge]`)
+	assert.Equal(t, 1, refunds)
+}
+
+func TestTypedErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error":"maintenance"}`))
+	}))
+	defer server.Close()
+
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("remote").Request(server.URL, flow.Retry(2, flow.Backoff(time.Millisecond, time.Millisecond, 1)))
+	dag.Node("local").Modify(func(data []byte) ([]byte, error) {
+		return nil, errors.New("bad input")
+	})
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	_, err := executor.ExecuteFlow([]byte(`{}`))
+
+	var multiErr *flow.MultiError
+	assert.True(t, errors.As(err, &multiErr))
+	assert.Equal(t, 2, len(multiErr.Errors))
+
+	var statusErr *flow.StatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusServiceUnavailable, statusErr.StatusCode)
+
+	var modifierErr *flow.ModifierError
+	assert.True(t, errors.As(err, &modifierErr))
+	assert.EqualError(t, modifierErr.Err, "bad input")
+
+	for _, nodeErr := range multiErr.Errors {
+		if nodeErr.NodeId == "remote" {
+			assert.Equal(t, "http-req-"+server.URL[len(server.URL)-16:], nodeErr.OperationId)
+			assert.Equal(t, 2, nodeErr.Attempt)
+			assert.Equal(t, http.StatusServiceUnavailable, nodeErr.StatusCode)
+			assert.Equal(t, `{"error":"maintenance"}`, nodeErr.Body)
+		} else {
+			assert.Equal(t, "modifier", nodeErr.OperationId)
+		}
+	}
+
+	workflow = new(flow.Workflow)
+	workflow.NewDag().Node("slow").Modify(func(data []byte) ([]byte, error) {
+		time.Sleep(100 * time.Millisecond)
+		return data, nil
+	}).Timeout(10 * time.Millisecond)
+	executor = flow.FlowExecutor{Flow: workflow}
+	_, err = executor.ExecuteFlow([]byte(`{}`))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+func TestPanics(t *testing.T) {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("modifier").Modify(func(data []byte) ([]byte, error) {
+		var values map[string]int
+		return nil, fmt.Errorf("%d", values["a"]/values["b"])
+	})
+	dag.Node("selector").Modify(func(data []byte) ([]byte, error) {
+		return data, nil
+	}).Switch(func(data []byte) (string, error) {
+		panic("no branch")
+	}).Default("after")
+	dag.Node("after").Modify(func(data []byte) ([]byte, error) {
+		return data, nil
+	})
+	dag.Edge("selector", "after")
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	_, err := executor.ExecuteFlow([]byte(`{}`))
+	var multiErr *flow.MultiError
+	assert.True(t, errors.As(err, &multiErr))
+	assert.Equal(t, 2, len(multiErr.Errors))
+	for _, nodeErr := range multiErr.Errors {
+		var panicErr *flow.PanicError
+		assert.True(t, errors.As(nodeErr, &panicErr))
+		assert.Contains(t, string(panicErr.Stack), "TestPanics")
+	}
+	assert.Contains(t, err.Error(), "panic: runtime error: integer divide by zero")
+	assert.Contains(t, err.Error(), "panic: no branch")
+
+	workflow = new(flow.Workflow)
+	dag = workflow.NewDag()
+	dag.Node("source").Modify(echo)
+	dag.Node("target").Modify(echo)
+	dag.EdgeIf("source", "target", func(*simplejson.Json) bool {
+		panic("bad condition")
+	})
+	executor = flow.FlowExecutor{Flow: workflow}
+	_, err = executor.ExecuteFlow([]byte(`{}`))
+	var nodeErr *flow.NodeError
+	assert.True(t, errors.As(err, &nodeErr))
+	assert.Equal(t, "source", nodeErr.NodeId)
+	assert.Contains(t, err.Error(), "panic: bad condition")
+
+	workflow = new(flow.Workflow)
+	dag = workflow.NewDag()
+	dag.Node("optional").Modify(func(data []byte) ([]byte, error) {
+		panic("optional failed")
+	}).ContinueOnError().Out("extra")
+	dag.Node("required").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"ok":true}`), nil
+	}).Out("ok")
+
+	executor = flow.FlowExecutor{Flow: workflow}
+	result, err := executor.Execute([]byte(`{}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"ok":true}`, string(result.Output))
+	assert.Contains(t, result.Errors[0].Error(), "panic: optional failed")
+
+	// a panic while compensating fails the compensation, not the caller
+	workflow = new(flow.Workflow)
+	dag = workflow.NewDag()
+	dag.Node("charge").Modify(echo).CompensateModify(echo)
+	dag.Node("ship").Modify(func(data []byte) ([]byte, error) {
+		return nil, errors.New("out of stock")
+	})
+	dag.Edge("charge", "ship")
+	executor = flow.FlowExecutor{Flow: workflow}
+	executor.Use(func(ctx context.Context, call *flow.OperationCall, data []byte, next flow.Invoker) ([]byte, error) {
+		if call.Compensation {
+			panic("bad refund")
+		}
+		return next(ctx, data)
+	})
+	_, err = executor.ExecuteFlow([]byte(`{}`))
+	var compensationErr *flow.CompensationError
+	if assert.True(t, errors.As(err, &compensationErr)) {
+		var panicErr *flow.PanicError
+		assert.True(t, errors.As(compensationErr.Compensations[0].Err, &panicErr))
+		assert.Equal(t, "bad refund", panicErr.Value)
+	}
+}
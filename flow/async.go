@@ -0,0 +1,235 @@
+package flow
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dafanshu/simplejson"
+)
+
+// ErrRunNotFinished is returned by Result for a run that is still running
+var ErrRunNotFinished = errors.New("run not finished")
+
+// NodeState is the progress of a node within a run
+type NodeState string
+
+const (
+	NodePending   NodeState = "pending"
+	NodeRunning   NodeState = "running"
+	NodeSucceeded NodeState = "succeeded"
+	NodeFailed    NodeState = "failed"
+	NodeSkipped   NodeState = "skipped"
+	NodeCancelled NodeState = "cancelled"
+)
+
+// RunState is the progress of a run
+type RunState string
+
+const (
+	RunRunning   RunState = "running"
+	RunSucceeded RunState = "succeeded"
+	RunFailed    RunState = "failed"
+)
+
+// NodeStatus is the state of a node, the times are zero until the node
+// starts and finishes
+type NodeStatus struct {
+	NodeId     string
+	State      NodeState
+	StartedAt  time.Time
+	FinishedAt time.Time
+}
+
+// Duration is the time the node ran for so far
+func (status NodeStatus) Duration() time.Duration {
+	switch {
+	case status.StartedAt.IsZero():
+		return 0
+	case status.FinishedAt.IsZero():
+		return time.Since(status.StartedAt)
+	}
+	return status.FinishedAt.Sub(status.StartedAt)
+}
+
+// RunStatus is a snapshot of the progress of a run
+type RunStatus struct {
+	RunId      string
+	State      RunState
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Nodes holds the state of every node in the order they were added
+	Nodes []NodeStatus
+	// Err is the error of a failed run
+	Err error
+}
+
+// runTracker records the progress of a run, it is written by the run and
+// read concurrently by Status
+type runTracker struct {
+	mu     sync.Mutex
+	status RunStatus
+	index  map[string]int
+	done   chan struct{}
+	result *RunResult
+	// events receives every change of a node state
+	events func(*Event)
+}
+
+func newRunTracker(compiled *CompiledFlow, runID string) *runTracker {
+	tracker := &runTracker{
+		status: RunStatus{RunId: runID, State: RunRunning, StartedAt: time.Now()},
+		index:  make(map[string]int, len(compiled.order)),
+		done:   make(chan struct{}),
+	}
+	for i, id := range compiled.order {
+		tracker.index[id] = i
+		tracker.status.Nodes = append(tracker.status.Nodes, NodeStatus{NodeId: id, State: NodePending})
+	}
+	return tracker
+}
+
+func (tracker *runTracker) node(id string, state NodeState, output *simplejson.Json, err error) {
+	if tracker == nil {
+		return
+	}
+	now := time.Now()
+	tracker.mu.Lock()
+	node := &tracker.status.Nodes[tracker.index[id]]
+	node.State = state
+	switch state {
+	case NodeRunning:
+		node.StartedAt = now
+	case NodeSucceeded, NodeFailed, NodeCancelled:
+		node.FinishedAt = now
+	}
+	tracker.mu.Unlock()
+
+	if tracker.events != nil {
+		event := &Event{RunId: tracker.status.RunId, NodeId: id, State: state, Time: now, Err: err}
+		if output != nil {
+			event.Output, _ = output.MarshalJSON()
+		}
+		tracker.events(event)
+	}
+}
+
+func (tracker *runTracker) finish(result *RunResult, err error) {
+	tracker.mu.Lock()
+	tracker.result = result
+	tracker.status.Err = err
+	tracker.status.FinishedAt = time.Now()
+	tracker.status.State = RunSucceeded
+	if err != nil {
+		tracker.status.State = RunFailed
+	}
+	tracker.mu.Unlock()
+	close(tracker.done)
+}
+
+func (tracker *runTracker) snapshot() *RunStatus {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	status := tracker.status
+	status.Nodes = append([]NodeStatus{}, tracker.status.Nodes...)
+	return &status
+}
+
+// Start runs the workflow in the background and returns the id of the run
+// at once, the run is then followed with Status, Wait and Result
+func (fexec *FlowExecutor) Start(request []byte) (string, error) {
+	compiled, err := fexec.compile()
+	if err != nil {
+		return "", err
+	}
+	return fexec.start(compiled, request, nil, nil)
+}
+
+// start registers a run and executes it in the background, onEvent
+// receives the events of the run and finished is called once it is over
+func (fexec *FlowExecutor) start(compiled *CompiledFlow, request []byte, onEvent func(*Event), finished func()) (string, error) {
+	runID := newRunID()
+	if fexec.Checkpoints != nil {
+		if err := fexec.Checkpoints.SaveRun(runID, request); err != nil {
+			return "", err
+		}
+	}
+	tracker := newRunTracker(compiled, runID)
+	tracker.events = onEvent
+	fexec.mu.Lock()
+	if fexec.runs == nil {
+		fexec.runs = make(map[string]*runTracker)
+	}
+	fexec.runs[runID] = tracker
+	fexec.mu.Unlock()
+
+	go func() {
+		tracker.finish(fexec.run(compiled, runID, request, nil, tracker))
+		// the run is over before its events end, for a reader of the
+		// events to find its result
+		if finished != nil {
+			finished()
+		}
+	}()
+	return runID, nil
+}
+
+func (fexec *FlowExecutor) tracker(runID string) (*runTracker, error) {
+	fexec.mu.Lock()
+	defer fexec.mu.Unlock()
+	tracker, ok := fexec.runs[runID]
+	if !ok {
+		return nil, ErrUnknownRun
+	}
+	return tracker, nil
+}
+
+// Status reports the progress of a run started with Start
+func (fexec *FlowExecutor) Status(runID string) (*RunStatus, error) {
+	tracker, err := fexec.tracker(runID)
+	if err != nil {
+		return nil, err
+	}
+	return tracker.snapshot(), nil
+}
+
+// Wait blocks until a run started with Start finishes and returns its result
+func (fexec *FlowExecutor) Wait(runID string) (*RunResult, error) {
+	tracker, err := fexec.tracker(runID)
+	if err != nil {
+		return nil, err
+	}
+	<-tracker.done
+	return tracker.result, tracker.status.Err
+}
+
+// Result returns the result of a finished run, or ErrRunNotFinished
+func (fexec *FlowExecutor) Result(runID string) (*RunResult, error) {
+	tracker, err := fexec.tracker(runID)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-tracker.done:
+		return tracker.result, tracker.status.Err
+	default:
+		return nil, ErrRunNotFinished
+	}
+}
+
+// Forget removes a finished run from the registry
+func (fexec *FlowExecutor) Forget(runID string) error {
+	tracker, err := fexec.tracker(runID)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-tracker.done:
+	default:
+		return ErrRunNotFinished
+	}
+	fexec.mu.Lock()
+	delete(fexec.runs, runID)
+	fexec.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,158 @@
+package flow
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/dafanshu/mini-flow/sdk"
+)
+
+// AutoWire adds the edges implied by the In and Out keys of the nodes
+// declared so far, from the producer of every In key to its reader. Edges
+// added with Edge are kept, so data and control dependencies can be mixed.
+//
+// An In key produced by several nodes is left alone when an explicit edge
+// already makes one of them upstream of the reader, and wired to the last
+// producer when the producers follow each other. Otherwise it is reported
+// as ambiguous, a "nodeId.key" reference or an explicit edge resolves it.
+// Keys no node produces are read from the global request. On error no
+// edge is added.
+func (flow *Workflow) AutoWire() error {
+	if flow.uflow == nil {
+		return errors.New("workflow has no DAG")
+	}
+	// the edges are planned on a copy of the graph and only added to the
+	// workflow once they are known to be sound
+	udag := sdk.NewDag()
+	nodes := flow.uflow.udag.Nodes()
+	for _, node := range nodes {
+		udag.AddV(node.Id)
+	}
+	for _, node := range nodes {
+		for _, successor := range flow.uflow.udag.Successors(node.Id) {
+			udag.AddE(node.Id, successor)
+		}
+	}
+	wired := make([]edge, 0)
+	wire := func(from, to string) {
+		if udag.AddE(from, to) == nil {
+			wired = append(wired, edge{from: from, to: to})
+		}
+	}
+	producers := make(map[string][]string)
+	for _, node := range nodes {
+		_, outputs := node.Offer()
+		for _, key := range outputs {
+			producers[key] = append(producers[key], node.Id)
+		}
+	}
+
+	type read struct {
+		reader string
+		key    string
+		from   []string
+	}
+	ambiguous := make([]read, 0)
+	for _, node := range nodes {
+		inputs, _ := node.Offer()
+		for _, key := range inputs {
+			if dot := strings.Index(key, "."); dot > 0 && udag.GetV(key[:dot]) != nil {
+				wire(key[:dot], node.Id)
+				continue
+			}
+			from := without(producers[key], node.Id)
+			switch len(from) {
+			case 0:
+			case 1:
+				wire(from[0], node.Id)
+			default:
+				ambiguous = append(ambiguous, read{reader: node.Id, key: key, from: from})
+			}
+		}
+	}
+
+	problems := make([]string, 0)
+	for _, r := range ambiguous {
+		ancestors := ancestorsOf(udag, r.reader)
+		if containsAny(ancestors, r.from) {
+			continue
+		}
+		if last := lastProducer(udag, r.from); last != "" {
+			wire(last, r.reader)
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%q read by %s is produced by %s",
+			r.key, r.reader, strings.Join(r.from, ", ")))
+	}
+	if cycle := udag.FindCycle(); cycle != nil {
+		problems = append(problems, "wiring creates cycle "+strings.Join(cycle, " -> "))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("auto wiring failed: %s", strings.Join(problems, "; "))
+	}
+	for _, e := range wired {
+		flow.uflow.Edge(e.from, e.to)
+	}
+	return nil
+}
+
+// ancestorsOf collects the transitive predecessors of a node
+func ancestorsOf(udag *sdk.Dag, id string) map[string]bool {
+	predecessors := make(map[string][]string)
+	for _, node := range udag.Nodes() {
+		for _, successor := range udag.Successors(node.Id) {
+			predecessors[successor] = append(predecessors[successor], node.Id)
+		}
+	}
+	ancestors := make(map[string]bool)
+	queue := []string{id}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, predecessor := range predecessors[current] {
+			if !ancestors[predecessor] {
+				ancestors[predecessor] = true
+				queue = append(queue, predecessor)
+			}
+		}
+	}
+	return ancestors
+}
+
+// lastProducer returns the producer having all the other producers as
+// ancestors, or empty when the producers may run in parallel
+func lastProducer(udag *sdk.Dag, producers []string) string {
+	for _, candidate := range producers {
+		ancestors := ancestorsOf(udag, candidate)
+		last := true
+		for _, other := range producers {
+			if other != candidate && !ancestors[other] {
+				last = false
+			}
+		}
+		if last {
+			return candidate
+		}
+	}
+	return ""
+}
+
+func containsAny(set map[string]bool, values []string) bool {
+	for _, value := range values {
+		if set[value] {
+			return true
+		}
+	}
+	return false
+}
+
+func without(values []string, value string) []string {
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
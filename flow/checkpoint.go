@@ -0,0 +1,266 @@
+package flow
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dafanshu/simplejson"
+)
+
+// ErrUnknownRun is returned for a run id a store or executor does not know
+var ErrUnknownRun = errors.New("unknown run")
+
+// NodeCheckpoint records a finished node of a run
+type NodeCheckpoint struct {
+	NodeId string `json:"nodeId"`
+	// Input and Output are the JSON input and outputs of the node
+	Input  []byte `json:"input,omitempty"`
+	Output []byte `json:"output,omitempty"`
+	// Branch and Route are the selected branch of a choice node and the
+	// node it routes to
+	Branch string `json:"branch,omitempty"`
+	Route  string `json:"route,omitempty"`
+	// Error is set for a node that failed without failing the run
+	Error string `json:"error,omitempty"`
+	// Compensated is set once the node was undone after the run failed, it
+	// voids the earlier checkpoints of the node so that a resumed run
+	// executes the node again
+	Compensated bool `json:"compensated,omitempty"`
+}
+
+// CheckpointStore keeps the progress of runs so that an interrupted run
+// can be resumed
+type CheckpointStore interface {
+	// SaveRun records the request a run was started with
+	SaveRun(runID string, request []byte) error
+	// SaveNode records a finished node of the run
+	SaveNode(runID string, checkpoint *NodeCheckpoint) error
+	// Load returns the request and the finished nodes of a run in the
+	// order they were saved
+	Load(runID string) ([]byte, []*NodeCheckpoint, error)
+	// Delete forgets a run
+	Delete(runID string) error
+}
+
+// MemoryCheckpointStore keeps checkpoints in process memory
+type MemoryCheckpointStore struct {
+	mu   sync.Mutex
+	runs map[string]*memoryRun
+}
+
+type memoryRun struct {
+	request     []byte
+	checkpoints []*NodeCheckpoint
+}
+
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{runs: make(map[string]*memoryRun)}
+}
+
+func (store *MemoryCheckpointStore) SaveRun(runID string, request []byte) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.runs[runID] = &memoryRun{request: request}
+	return nil
+}
+
+func (store *MemoryCheckpointStore) SaveNode(runID string, checkpoint *NodeCheckpoint) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	run, ok := store.runs[runID]
+	if !ok {
+		return ErrUnknownRun
+	}
+	run.checkpoints = append(run.checkpoints, checkpoint)
+	return nil
+}
+
+func (store *MemoryCheckpointStore) Load(runID string) ([]byte, []*NodeCheckpoint, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	run, ok := store.runs[runID]
+	if !ok {
+		return nil, nil, ErrUnknownRun
+	}
+	return run.request, append([]*NodeCheckpoint{}, run.checkpoints...), nil
+}
+
+func (store *MemoryCheckpointStore) Delete(runID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.runs, runID)
+	return nil
+}
+
+// FileCheckpointStore keeps the checkpoints of every run in a file of Dir,
+// one JSON record per line, synced to disk as they are written
+type FileCheckpointStore struct {
+	Dir string
+	mu  sync.Mutex
+}
+
+type checkpointRecord struct {
+	Request []byte          `json:"request,omitempty"`
+	Node    *NodeCheckpoint `json:"node,omitempty"`
+}
+
+func NewFileCheckpointStore(dir string) (*FileCheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileCheckpointStore{Dir: dir}, nil
+}
+
+// path names the file of a run after the hex encoded run id, so that a run
+// id from a caller never reaches outside Dir
+func (store *FileCheckpointStore) path(runID string) string {
+	return filepath.Join(store.Dir, hex.EncodeToString([]byte(runID))+".checkpoint")
+}
+
+func (store *FileCheckpointStore) SaveRun(runID string, request []byte) error {
+	return store.write(runID, &checkpointRecord{Request: request}, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+}
+
+func (store *FileCheckpointStore) SaveNode(runID string, checkpoint *NodeCheckpoint) error {
+	return store.write(runID, &checkpointRecord{Node: checkpoint}, os.O_APPEND|os.O_WRONLY)
+}
+
+func (store *FileCheckpointStore) write(runID string, record *checkpointRecord, flag int) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	file, err := os.OpenFile(store.path(runID), flag, 0644)
+	if os.IsNotExist(err) {
+		return ErrUnknownRun
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (store *FileCheckpointStore) Load(runID string) ([]byte, []*NodeCheckpoint, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	file, err := os.Open(store.path(runID))
+	if os.IsNotExist(err) {
+		return nil, nil, ErrUnknownRun
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	var request []byte
+	checkpoints := make([]*NodeCheckpoint, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		record := &checkpointRecord{}
+		// a line cut short by a crash is the end of the checkpoints
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			break
+		}
+		if record.Node != nil {
+			checkpoints = append(checkpoints, record.Node)
+		} else {
+			request = record.Request
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return request, checkpoints, nil
+}
+
+func (store *FileCheckpointStore) Delete(runID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	err := os.Remove(store.path(runID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// checkpoint records a finished node, a store failure only costs the
+// ability to resume the node and does not fail the run
+func (run *flowRun) checkpoint(result *nodeResult) {
+	if run.checkpoints == nil || result.restored {
+		return
+	}
+	checkpoint := &NodeCheckpoint{
+		NodeId: result.node.id,
+		Input:  result.input,
+		Branch: result.branch,
+		Route:  result.route,
+	}
+	if result.output != nil {
+		checkpoint.Output, _ = result.output.MarshalJSON()
+	}
+	if result.err != nil {
+		checkpoint.Error = asNodeError(result.node.id, result.err).Err.Error()
+	}
+	run.saveCheckpoint(checkpoint)
+}
+
+// checkpointCompensated records that a node was undone
+func (run *flowRun) checkpointCompensated(node *compiledNode) {
+	if run.checkpoints == nil {
+		return
+	}
+	run.saveCheckpoint(&NodeCheckpoint{NodeId: node.id, Compensated: true})
+}
+
+func (run *flowRun) saveCheckpoint(checkpoint *NodeCheckpoint) {
+	if err := run.checkpoints.SaveNode(run.runID, checkpoint); err != nil {
+		run.logf(checkpoint.NodeId, "Checkpointing node `%s` failed, %v", checkpoint.NodeId, err)
+	}
+}
+
+// restore turns the checkpoints of an interrupted run into results that
+// the scheduler takes instead of running the nodes again
+func (run *flowRun) restore(checkpoints []*NodeCheckpoint) error {
+	for _, checkpoint := range checkpoints {
+		node, ok := run.flow.nodes[checkpoint.NodeId]
+		if !ok {
+			return fmt.Errorf("run %s has a checkpoint of unknown node %s", run.runID, checkpoint.NodeId)
+		}
+		if checkpoint.Compensated {
+			delete(run.restored, node.id)
+			continue
+		}
+		result := &nodeResult{
+			node:     node,
+			input:    checkpoint.Input,
+			branch:   checkpoint.Branch,
+			route:    checkpoint.Route,
+			restored: true,
+		}
+		if checkpoint.Output != nil {
+			output, err := simplejson.NewJson(checkpoint.Output)
+			if err != nil {
+				return fmt.Errorf("run %s has a bad checkpoint of node %s, %v", run.runID, node.id, err)
+			}
+			result.output = output
+		}
+		if checkpoint.Error != "" {
+			result.err = errors.New(checkpoint.Error)
+		}
+		run.restored[node.id] = result
+	}
+	return nil
+}
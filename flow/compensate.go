@@ -0,0 +1,126 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/dafanshu/simplejson"
+)
+
+// Compensation is the outcome of undoing a node after its run failed
+type Compensation struct {
+	NodeId string
+	Output []byte
+	Err    error
+}
+
+// CompensationError is returned when a run failed after nodes with
+// compensating operations had succeeded, Cause is the failure of the run
+type CompensationError struct {
+	Cause         error
+	Compensations []*Compensation
+}
+
+func (err *CompensationError) Error() string {
+	undone := make([]string, 0, len(err.Compensations))
+	failed := make([]string, 0)
+	for _, compensation := range err.Compensations {
+		if compensation.Err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", compensation.NodeId, compensation.Err))
+		} else {
+			undone = append(undone, compensation.NodeId)
+		}
+	}
+	message := fmt.Sprintf("%v, compensated nodes: [%s]", err.Cause, strings.Join(undone, ","))
+	if len(failed) > 0 {
+		message += fmt.Sprintf(", failed compensations: [%s]", strings.Join(failed, ","))
+	}
+	return message
+}
+
+func (err *CompensationError) Unwrap() error {
+	return err.Cause
+}
+
+// Compensate adds an http request that undoes the node when the run fails
+// after the node succeeded. Compensations run in the reverse order the
+// nodes completed, each gets the input of its node merged with its outputs.
+func (node *Node) Compensate(url string, opts ...Option) *Node {
+	operation := createHttpRequest(url)
+	operation.applyOptions(opts)
+	node.spec.compensations = append(node.spec.compensations, operation)
+	return node
+}
+
+// CompensateApply is Compensate with a function call
+func (node *Node) CompensateApply(function string, opts ...Option) *Node {
+	operation := createFunction(function)
+	operation.applyOptions(opts)
+	node.spec.compensations = append(node.spec.compensations, operation)
+	return node
+}
+
+// CompensateModify is Compensate with a modifier
+func (node *Node) CompensateModify(mod Modifier, opts ...Option) *Node {
+	operation := createModifier(mod)
+	operation.applyOptions(opts)
+	node.spec.compensations = append(node.spec.compensations, operation)
+	return node
+}
+
+// compensate undoes the completed nodes of a failed run, the latest first
+func (run *flowRun) compensate(cause error) error {
+	compensations := make([]*Compensation, 0)
+	for i := len(run.completed) - 1; i >= 0; i-- {
+		result := run.completed[i]
+		if len(result.node.compensations) == 0 {
+			continue
+		}
+		run.logf(result.node.id, "Compensating node `%s`", result.node.id)
+		compensation := &Compensation{NodeId: result.node.id}
+		// a panic of a compensation fails that compensation, not the caller
+		compensation.Output, compensation.Err = protect(func() ([]byte, error) {
+			return run.undo(result)
+		})
+		if compensation.Err != nil {
+			run.logf(result.node.id, "Compensating node `%s` failed, %v", result.node.id, compensation.Err)
+		} else {
+			run.checkpointCompensated(result.node)
+		}
+		compensations = append(compensations, compensation)
+	}
+	if len(compensations) == 0 {
+		return cause
+	}
+	return &CompensationError{Cause: cause, Compensations: compensations}
+}
+
+func (run *flowRun) undo(result *nodeResult) ([]byte, error) {
+	data, err := simplejson.NewJson(result.input)
+	if err != nil {
+		data = simplejson.New()
+	}
+	if result.output != nil {
+		for _, key := range result.output.Keys() {
+			data.Set(key, result.output.Get(key))
+		}
+	}
+	payload, err := data.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	// the run context may be done already, compensations get their own
+	ctx, cancel := context.WithTimeout(context.Background(), run.compensationTimeout)
+	defer cancel()
+	task := run.newTask(result.node)
+	task.compensating = true
+	for _, operation := range result.node.compensations {
+		payload, err = task.invoke(ctx, operation, payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return payload, nil
+}
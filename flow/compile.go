@@ -0,0 +1,370 @@
+package flow
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dafanshu/mini-flow/sdk"
+	"github.com/dafanshu/simplejson"
+)
+
+// CompiledFlow is an immutable snapshot of a Workflow. Every run keeps its
+// own execution state, so one CompiledFlow can be executed any number of
+// times, concurrently.
+type CompiledFlow struct {
+	nodes   map[string]*compiledNode
+	order   []string
+	finals  []string
+	outputs []compiledOutput
+}
+
+type compiledOutput struct {
+	field  string
+	source string
+	key    string
+	// producers are the nodes declaring key, the latest stage first
+	producers []string
+}
+
+type compiledNode struct {
+	id           string
+	inputs       []string
+	outputs      []string
+	operations   []sdk.Operation
+	successors   []string
+	predecessors []string
+	// ancestors are ordered from the nearest to the farthest
+	ancestors []string
+	inDegree  int
+	// stage is the length of the longest path from a start node
+	stage int
+	// conditions guard the edges to successors, keyed by successor id
+	conditions map[string]Condition
+	// quorum is the number of followed inbound edges the node runs on
+	quorum int
+	// result is set when the run result reads the outputs of the node
+	result bool
+	// fallbackOutput is the parsed fallback of the node
+	fallbackOutput *simplejson.Json
+	nodeSpec
+}
+
+// Compile 校验工作流并生成不可变的执行快照
+func (flow *Workflow) Compile() (*CompiledFlow, error) {
+	return flow.compile(make(map[*Workflow]bool))
+}
+
+// compile compiles the workflow and the sub workflows it embeds, visiting
+// holds the workflows being compiled to reject a workflow embedding itself
+func (flow *Workflow) compile(visiting map[*Workflow]bool) (*CompiledFlow, error) {
+	if visiting[flow] {
+		return nil, errors.New("workflow embeds itself as a sub workflow")
+	}
+	visiting[flow] = true
+	defer delete(visiting, flow)
+
+	if flow.uflow == nil {
+		return nil, errors.New("workflow has no DAG")
+	}
+	if err := flow.IsLegal(); err != nil {
+		return nil, err
+	}
+
+	udag := flow.uflow.udag
+	compiled := &CompiledFlow{nodes: make(map[string]*compiledNode)}
+	for _, unode := range udag.Nodes() {
+		input, output := unode.Offer()
+		node := &compiledNode{
+			id:         unode.Id,
+			inputs:     append([]string{}, input...),
+			outputs:    append([]string{}, output...),
+			operations: append([]sdk.Operation{}, unode.Operations()...),
+			successors: udag.Successors(unode.Id),
+			inDegree:   unode.InDegree(),
+		}
+		for i, operation := range node.operations {
+			if sub, ok := operation.(*subFlowOperation); ok {
+				child, err := sub.flow.compile(visiting)
+				if err != nil {
+					return nil, fmt.Errorf("subflow node %s: %v", unode.Id, err)
+				}
+				node.operations[i] = &subFlowOperation{flow: sub.flow, compiled: child}
+			}
+		}
+		if spec, ok := flow.uflow.specs[unode.Id]; ok {
+			node.nodeSpec = *spec
+			if spec.choice != nil {
+				if spec.choice.selector == nil {
+					return nil, fmt.Errorf("choice node %s has no selector", unode.Id)
+				}
+				node.choice = spec.choice.copy()
+			}
+			if spec.forEach != nil {
+				if len(node.outputs) == 0 {
+					return nil, fmt.Errorf("foreach node %s has no Out key", unode.Id)
+				}
+				each := *spec.forEach
+				node.forEach = &each
+				if each.errorsKey != "" && !node.provides(each.errorsKey) {
+					node.outputs = append(node.outputs, each.errorsKey)
+				}
+			}
+			if spec.join.quorum > node.inDegree {
+				return nil, fmt.Errorf("node %s: quorum %d exceeds its %d predecessors",
+					unode.Id, spec.join.quorum, node.inDegree)
+			}
+			node.quorum = spec.join.quorum
+			node.compensations = append([]sdk.Operation{}, spec.compensations...)
+			node.interceptors = append([]Interceptor{}, spec.interceptors...)
+			if spec.fallback != nil {
+				fallback, err := simplejson.NewJson(spec.fallback)
+				if err != nil {
+					return nil, fmt.Errorf("node %s: fallback is not JSON, %v", unode.Id, err)
+				}
+				node.fallbackOutput = simplejson.New()
+				for _, key := range node.outputs {
+					if value, ok := fallback.CheckGet(key); ok {
+						node.fallbackOutput.Set(key, value)
+					}
+				}
+			}
+			if spec.loop != nil {
+				l, err := spec.loop.compile()
+				if err != nil {
+					return nil, fmt.Errorf("loop node %s: %v", unode.Id, err)
+				}
+				node.loop = l
+			}
+		}
+		compiled.nodes[node.id] = node
+		compiled.order = append(compiled.order, node.id)
+	}
+	for _, id := range compiled.order {
+		for _, successor := range compiled.nodes[id].successors {
+			node := compiled.nodes[successor]
+			node.predecessors = append(node.predecessors, id)
+		}
+	}
+	if err := compiled.assignConditions(flow.uflow.conditions); err != nil {
+		return nil, err
+	}
+	compiled.assignStages()
+	compiled.assignAncestors()
+	if err := compiled.assignOutputs(flow.outputs); err != nil {
+		return nil, err
+	}
+	if len(compiled.outputs) == 0 {
+		for _, id := range compiled.finals {
+			compiled.nodes[id].result = true
+		}
+	}
+	for _, output := range compiled.outputs {
+		for _, id := range output.producers {
+			compiled.nodes[id].result = true
+		}
+	}
+	return compiled, nil
+}
+
+func (compiled *CompiledFlow) assignConditions(conditions map[edge]edgeCondition) error {
+	for edge, condition := range conditions {
+		cond := condition.cond
+		if condition.expr != "" {
+			var err error
+			cond, err = ParseCondition(condition.expr)
+			if err != nil {
+				return fmt.Errorf("edge %s -> %s: %v", edge.from, edge.to, err)
+			}
+		}
+		node := compiled.nodes[edge.from]
+		if node.conditions == nil {
+			node.conditions = make(map[string]Condition)
+		}
+		node.conditions[edge.to] = cond
+	}
+	return nil
+}
+
+// follows reports whether the edge to successor is followed given the
+// outputs of the node and, for a choice node, the node its branch routed to
+func (node *compiledNode) follows(successor string, output *simplejson.Json, route string) bool {
+	if node.choice != nil && node.choice.routes(successor) && successor != route {
+		return false
+	}
+	cond, ok := node.conditions[successor]
+	if !ok || cond == nil {
+		return true
+	}
+	if output == nil {
+		output = simplejson.New()
+	}
+	return cond(output)
+}
+
+func (c *choice) copy() *choice {
+	cases := make(map[string]string, len(c.cases))
+	for branch, to := range c.cases {
+		cases[branch] = to
+	}
+	return &choice{selector: c.selector, cases: cases, defaultNode: c.defaultNode}
+}
+
+// routes reports whether the node is the target of a branch
+func (c *choice) routes(id string) bool {
+	if c.defaultNode == id {
+		return true
+	}
+	for _, to := range c.cases {
+		if to == id {
+			return true
+		}
+	}
+	return false
+}
+
+// route selects the branch from the result of the choice node and returns
+// the node it activates
+func (c *choice) route(nodeId string, result []byte) (string, string, error) {
+	branch, err := c.selector(result)
+	if err != nil {
+		return "", "", fmt.Errorf("choice node %s: %v", nodeId, err)
+	}
+	if to, ok := c.cases[branch]; ok {
+		return branch, to, nil
+	}
+	if c.defaultNode != "" {
+		return branch, c.defaultNode, nil
+	}
+	return "", "", fmt.Errorf("choice node %s: no branch for %q and no default", nodeId, branch)
+}
+
+// assignStages places every node one stage after its deepest predecessor and
+// records the nodes of the last stage, whose outputs form the run result
+func (compiled *CompiledFlow) assignStages() {
+	inDegree := make(map[string]int, len(compiled.nodes))
+	queue := make([]string, 0, len(compiled.nodes))
+	for _, id := range compiled.order {
+		inDegree[id] = compiled.nodes[id].inDegree
+		if inDegree[id] == 0 {
+			queue = append(queue, id)
+		}
+	}
+	lastStage := 0
+	for len(queue) > 0 {
+		node := compiled.nodes[queue[0]]
+		queue = queue[1:]
+		if node.stage > lastStage {
+			lastStage = node.stage
+		}
+		for _, id := range node.successors {
+			successor := compiled.nodes[id]
+			if node.stage+1 > successor.stage {
+				successor.stage = node.stage + 1
+			}
+			inDegree[id]--
+			if inDegree[id] == 0 {
+				queue = append(queue, id)
+			}
+		}
+	}
+	for _, id := range compiled.order {
+		if compiled.nodes[id].stage == lastStage {
+			compiled.finals = append(compiled.finals, id)
+		}
+	}
+}
+
+// assignAncestors collects the transitive predecessors of every node, the
+// deeper an ancestor is placed the earlier it is consulted for an input key
+func (compiled *CompiledFlow) assignAncestors() {
+	index := make(map[string]int, len(compiled.order))
+	for i, id := range compiled.order {
+		index[id] = i
+	}
+	sets := make(map[string]map[string]bool, len(compiled.nodes))
+	var collect func(id string) map[string]bool
+	collect = func(id string) map[string]bool {
+		if set, ok := sets[id]; ok {
+			return set
+		}
+		set := make(map[string]bool)
+		for _, predecessor := range compiled.nodes[id].predecessors {
+			set[predecessor] = true
+			for ancestor := range collect(predecessor) {
+				set[ancestor] = true
+			}
+		}
+		sets[id] = set
+		return set
+	}
+	for _, id := range compiled.order {
+		node := compiled.nodes[id]
+		for ancestor := range collect(id) {
+			node.ancestors = append(node.ancestors, ancestor)
+		}
+		sort.Slice(node.ancestors, func(i, j int) bool {
+			a, b := compiled.nodes[node.ancestors[i]], compiled.nodes[node.ancestors[j]]
+			if a.stage != b.stage {
+				return a.stage > b.stage
+			}
+			return index[a.id] > index[b.id]
+		})
+	}
+}
+
+// assignOutputs resolves the declared workflow outputs to their producers
+func (compiled *CompiledFlow) assignOutputs(outputs []output) error {
+	for _, declared := range outputs {
+		producer, key, qualified := compiled.splitRef(declared.source)
+		result := compiledOutput{field: declared.field, source: declared.source, key: key}
+		if result.field == "" {
+			result.field = key
+		}
+		if qualified {
+			result.producers = []string{producer}
+		} else {
+			for i := len(compiled.order) - 1; i >= 0; i-- {
+				if compiled.nodes[compiled.order[i]].provides(key) {
+					result.producers = append(result.producers, compiled.order[i])
+				}
+			}
+			sort.SliceStable(result.producers, func(i, j int) bool {
+				return compiled.nodes[result.producers[i]].stage > compiled.nodes[result.producers[j]].stage
+			})
+		}
+		if len(result.producers) == 0 || !compiled.nodes[result.producers[0]].provides(key) {
+			return fmt.Errorf("workflow output %q is not an output of any node", declared.source)
+		}
+		compiled.outputs = append(compiled.outputs, result)
+	}
+	return nil
+}
+
+func (node *compiledNode) provides(key string) bool {
+	for _, output := range node.outputs {
+		if output == key {
+			return true
+		}
+	}
+	return false
+}
+
+// splitRef splits a "nodeId.key" reference into its node id and key, the
+// reference is only qualified when the prefix names a node of the flow
+func (compiled *CompiledFlow) splitRef(ref string) (string, string, bool) {
+	dot := strings.Index(ref, ".")
+	if dot <= 0 || dot == len(ref)-1 {
+		return "", ref, false
+	}
+	if _, ok := compiled.nodes[ref[:dot]]; !ok {
+		return "", ref, false
+	}
+	return ref[:dot], ref[dot+1:], true
+}
+
+// NodeIds returns the ids of all nodes in the order they were added
+func (compiled *CompiledFlow) NodeIds() []string {
+	return append([]string{}, compiled.order...)
+}
@@ -0,0 +1,345 @@
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/dafanshu/simplejson"
+)
+
+// ParseCondition compiles a condition expression over a node's outputs.
+//
+// An expression compares output keys, or dotted paths into them, with
+// literals: `amount > 1000`, `status == "done" && !retry`. The comparison
+// operators are ==, !=, >, >=, < and <=, conditions combine with &&, || and
+// !, and a bare key is true unless it is missing, false, 0, "" or null.
+func ParseCondition(expr string) (Condition, error) {
+	p := &condParser{tokens: tokenize(expr)}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("condition %q is empty", expr)
+	}
+	eval, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("condition %q: %v", expr, err)
+	}
+	return func(data *simplejson.Json) bool {
+		return truthy(eval(data))
+	}, nil
+}
+
+type condEval func(*simplejson.Json) interface{}
+
+const (
+	tokenIdent = iota
+	tokenNumber
+	tokenString
+	tokenOp
+)
+
+type condToken struct {
+	kind int
+	text string
+}
+
+type condParser struct {
+	tokens []condToken
+	pos    int
+}
+
+func tokenize(expr string) []condToken {
+	tokens := make([]condToken, 0)
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			j := i + 1
+			for j < len(runes) && runes[j] != r {
+				if runes[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			text := string(runes[i+1 : minInt(j, len(runes))])
+			tokens = append(tokens, condToken{kind: tokenString, text: strings.Replace(text, "\\"+string(r), string(r), -1)})
+			i = j + 1
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			j := i + 1
+			for j < len(runes) && (unicode.IsDigit(runes[j]) || runes[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, condToken{kind: tokenNumber, text: string(runes[i:j])})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j]) || strings.ContainsRune("_-.", runes[j])) {
+				j++
+			}
+			tokens = append(tokens, condToken{kind: tokenIdent, text: string(runes[i:j])})
+			i = j
+		default:
+			op := string(r)
+			if i+1 < len(runes) {
+				switch two := string(runes[i : i+2]); two {
+				case "==", "!=", ">=", "<=", "&&", "||":
+					op = two
+				}
+			}
+			tokens = append(tokens, condToken{kind: tokenOp, text: op})
+			i += len([]rune(op))
+		}
+	}
+	return tokens
+}
+
+func (p *condParser) peekOp(ops ...string) (string, bool) {
+	if p.pos >= len(p.tokens) || p.tokens[p.pos].kind != tokenOp {
+		return "", false
+	}
+	for _, op := range ops {
+		if p.tokens[p.pos].text == op {
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *condParser) parseOr() (condEval, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOp("||"); !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(data *simplejson.Json) interface{} {
+			return truthy(l(data)) || truthy(right(data))
+		}
+	}
+}
+
+func (p *condParser) parseAnd() (condEval, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.peekOp("&&"); !ok {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(data *simplejson.Json) interface{} {
+			return truthy(l(data)) && truthy(right(data))
+		}
+	}
+}
+
+func (p *condParser) parseUnary() (condEval, error) {
+	if _, ok := p.peekOp("!"); ok {
+		p.pos++
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(data *simplejson.Json) interface{} {
+			return !truthy(operand(data))
+		}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *condParser) parseComparison() (condEval, error) {
+	if _, ok := p.peekOp("("); ok {
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := p.peekOp(")"); !ok {
+			return nil, fmt.Errorf("missing )")
+		}
+		p.pos++
+		return inner, nil
+	}
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.peekOp("==", "!=", ">", ">=", "<", "<=")
+	if !ok {
+		return left, nil
+	}
+	p.pos++
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return func(data *simplejson.Json) interface{} {
+		return compare(left(data), op, right(data))
+	}, nil
+}
+
+func (p *condParser) parseOperand() (condEval, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, fmt.Errorf("unexpected end")
+	}
+	token := p.tokens[p.pos]
+	p.pos++
+	switch token.kind {
+	case tokenNumber:
+		number, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", token.text)
+		}
+		return constant(number), nil
+	case tokenString:
+		return constant(token.text), nil
+	case tokenIdent:
+		switch token.text {
+		case "true":
+			return constant(true), nil
+		case "false":
+			return constant(false), nil
+		case "null":
+			return constant(nil), nil
+		}
+		path := token.text
+		return func(data *simplejson.Json) interface{} {
+			return lookupPath(data, path)
+		}, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", token.text)
+}
+
+func constant(value interface{}) condEval {
+	return func(*simplejson.Json) interface{} {
+		return value
+	}
+}
+
+// jsonValue unwraps the simplejson values that node outputs are built from
+func jsonValue(data interface{}) interface{} {
+	for {
+		js, ok := data.(*simplejson.Json)
+		if !ok || js == nil {
+			return data
+		}
+		data = js.Interface()
+	}
+}
+
+// lookupPath returns the value at a dotted path, or nil when it is missing
+func lookupPath(data *simplejson.Json, path string) interface{} {
+	var current interface{} = data
+	for _, part := range strings.Split(path, ".") {
+		object, ok := jsonValue(current).(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		current = object[part]
+	}
+	return jsonValue(current)
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case json.Number:
+		number, err := v.Float64()
+		return number, err == nil
+	}
+	return 0, false
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	}
+	if number, ok := toNumber(value); ok {
+		return number != 0
+	}
+	return true
+}
+
+func compare(left interface{}, op string, right interface{}) bool {
+	if l, ok := toNumber(left); ok {
+		if r, ok := toNumber(right); ok {
+			switch op {
+			case "==":
+				return l == r
+			case "!=":
+				return l != r
+			case ">":
+				return l > r
+			case ">=":
+				return l >= r
+			case "<":
+				return l < r
+			case "<=":
+				return l <= r
+			}
+		}
+	}
+	if l, ok := left.(string); ok {
+		if r, ok := right.(string); ok {
+			switch op {
+			case "==":
+				return l == r
+			case "!=":
+				return l != r
+			case ">":
+				return l > r
+			case ">=":
+				return l >= r
+			case "<":
+				return l < r
+			case "<=":
+				return l <= r
+			}
+		}
+	}
+	switch op {
+	case "==":
+		return fmt.Sprint(left) == fmt.Sprint(right)
+	case "!=":
+		return fmt.Sprint(left) != fmt.Sprint(right)
+	}
+	return false
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
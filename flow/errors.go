@@ -0,0 +1,262 @@
+package flow
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// TimeoutError reports an operation that was stopped because the timeout of
+// its node or of the operation itself expired
+type TimeoutError struct {
+	NodeId      string
+	OperationId string
+	// Level is "node" or "operation", whichever timeout expired
+	Level   string
+	Timeout time.Duration
+}
+
+func (err *TimeoutError) Error() string {
+	return fmt.Sprintf("node `%s` operation `%s`: %s timeout of %s exceeded",
+		err.NodeId, err.OperationId, err.Level, err.Timeout)
+}
+
+// Unwrap lets errors.Is match context.DeadlineExceeded
+func (err *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+// StatusError reports a non 2xx response of an http call
+type StatusError struct {
+	StatusCode int
+	URL        string
+	// Body is the beginning of the response body
+	Body string
+}
+
+// maxBodyExcerpt is the length of the response body kept by a StatusError
+const maxBodyExcerpt = 512
+
+func newStatusError(statusCode int, url string, body []byte) *StatusError {
+	if len(body) > maxBodyExcerpt {
+		body = body[:maxBodyExcerpt]
+	}
+	return &StatusError{StatusCode: statusCode, URL: url, Body: string(body)}
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("invalid return status %d while connecting %s", err.StatusCode, err.URL)
+}
+
+// ModifierError reports the failure of a modifier
+type ModifierError struct {
+	Err error
+}
+
+func (err *ModifierError) Error() string {
+	return fmt.Sprintf("error: Failed at modifier, %v", err.Err)
+}
+
+func (err *ModifierError) Unwrap() error {
+	return err.Err
+}
+
+// PanicError reports a panic recovered while running a node
+type PanicError struct {
+	Value interface{}
+	// Stack is the stack trace of the goroutine that panicked
+	Stack []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", err.Value)
+}
+
+// recovered turns the value of a recovered panic into a PanicError, it is
+// called from the deferred function that recovered so that the stack
+// still holds the panicking frames
+func recovered(value interface{}) *PanicError {
+	return &PanicError{Value: value, Stack: debug.Stack()}
+}
+
+// protect runs call and reports a panic in it as a PanicError
+func protect(call func() ([]byte, error)) (result []byte, err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			result, err = nil, recovered(value)
+		}
+	}()
+	return call()
+}
+
+// callError reports a failed function or http call after its last attempt
+type callError struct {
+	message  string
+	attempts int
+	err      error
+}
+
+func (err *callError) Error() string {
+	return fmt.Sprintf("%s%s, %v", err.message, attemptsNote(err.attempts), err.err)
+}
+
+func (err *callError) Unwrap() error {
+	return err.err
+}
+
+// FailFastError reports the failure that stopped a fail-fast run together
+// with the running nodes that were cancelled because of it
+type FailFastError struct {
+	Cause     error
+	Cancelled []string
+}
+
+func (err *FailFastError) Error() string {
+	return fmt.Sprintf("%v, cancelled nodes: [%s]", err.Cause, strings.Join(err.Cancelled, ","))
+}
+
+func (err *FailFastError) Unwrap() error {
+	return err.Cause
+}
+
+// NodeError is the failure of a single node
+type NodeError struct {
+	NodeId string
+	// OperationId names the operation of the node that failed, if any
+	OperationId string
+	// Attempt is the number of attempts made by a failed function or http
+	// call
+	Attempt int
+	// StatusCode and Body are the status and the beginning of the body of
+	// a non 2xx response
+	StatusCode int
+	Body       string
+	Err        error
+}
+
+// newNodeError builds the NodeError of a node from the error of one of its
+// operations, taking the details of the call from the error chain
+func newNodeError(nodeId, operationId string, err error) *NodeError {
+	nodeErr := &NodeError{NodeId: nodeId, OperationId: operationId, Err: err}
+	var inner *NodeError
+	if errors.As(err, &inner) {
+		nodeErr.OperationId = inner.OperationId
+		nodeErr.Attempt = inner.Attempt
+		nodeErr.StatusCode = inner.StatusCode
+		nodeErr.Body = inner.Body
+		return nodeErr
+	}
+	var call *callError
+	if errors.As(err, &call) {
+		nodeErr.Attempt = call.attempts
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		nodeErr.StatusCode = statusErr.StatusCode
+		nodeErr.Body = statusErr.Body
+	}
+	return nodeErr
+}
+
+// asNodeError returns err as the NodeError of the node
+func asNodeError(nodeId string, err error) *NodeError {
+	if nodeErr, ok := err.(*NodeError); ok {
+		return nodeErr
+	}
+	return newNodeError(nodeId, "", err)
+}
+
+func (err *NodeError) Error() string {
+	return fmt.Sprintf("node `%s`: %v", err.NodeId, err.Err)
+}
+
+func (err *NodeError) Unwrap() error {
+	return err.Err
+}
+
+// MultiError holds the failures of all the nodes that failed a run, it
+// matches errors.Is and errors.As against each of them
+type MultiError struct {
+	Errors []*NodeError
+}
+
+func (err *MultiError) Error() string {
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for _, nodeErr := range err.Errors {
+		buffer.WriteString(nodeErr.Err.Error())
+		buffer.WriteString(",")
+	}
+	buffer.WriteString("]")
+	return buffer.String()
+}
+
+func (err *MultiError) Unwrap() []error {
+	return nodeErrs(err.Errors)
+}
+
+func (err *MultiError) Is(target error) bool {
+	return isAny(err.Errors, target)
+}
+
+func (err *MultiError) As(target interface{}) bool {
+	return asAny(err.Errors, target)
+}
+
+func nodeErrs(nodeErrs []*NodeError) []error {
+	errs := make([]error, 0, len(nodeErrs))
+	for _, nodeErr := range nodeErrs {
+		errs = append(errs, nodeErr)
+	}
+	return errs
+}
+
+// isAny and asAny let errors.Is and errors.As see every error of a
+// MultiError or PartialError with a Go version not unwrapping to a slice
+func isAny(nodeErrs []*NodeError, target error) bool {
+	for _, nodeErr := range nodeErrs {
+		if errors.Is(nodeErr, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func asAny(nodeErrs []*NodeError, target interface{}) bool {
+	for _, nodeErr := range nodeErrs {
+		if errors.As(nodeErr, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// PartialError is returned by ExecuteFlow together with the partial result
+// when nodes failed without failing the run
+type PartialError struct {
+	Errors []*NodeError
+}
+
+func (err *PartialError) Error() string {
+	messages := make([]string, 0, len(err.Errors))
+	for _, nodeErr := range err.Errors {
+		messages = append(messages, nodeErr.Error())
+	}
+	return fmt.Sprintf("partial result, %d node(s) failed: [%s]", len(err.Errors), strings.Join(messages, ","))
+}
+
+func (err *PartialError) Unwrap() []error {
+	return nodeErrs(err.Errors)
+}
+
+func (err *PartialError) Is(target error) bool {
+	return isAny(err.Errors, target)
+}
+
+func (err *PartialError) As(target interface{}) bool {
+	return asAny(err.Errors, target)
+}
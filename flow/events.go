@@ -0,0 +1,58 @@
+package flow
+
+import "time"
+
+// Event reports a node of a run changing its state
+type Event struct {
+	RunId  string
+	NodeId string
+	// State is running when the node starts, then succeeded, failed,
+	// skipped or cancelled
+	State NodeState
+	// Output holds the Out values of a succeeded node
+	Output []byte
+	// Err is the error of a failed or cancelled node
+	Err  error
+	Time time.Time
+}
+
+// ExecuteWithEvents runs the workflow like Execute and calls onEvent for
+// every node start, completion, failure and skip as it happens. The calls
+// are made one at a time, in the order of the events.
+func (fexec *FlowExecutor) ExecuteWithEvents(request []byte, onEvent func(*Event)) (*RunResult, error) {
+	compiled, err := fexec.compile()
+	if err != nil {
+		return nil, err
+	}
+	runID := newRunID()
+	if fexec.Checkpoints != nil {
+		if err := fexec.Checkpoints.SaveRun(runID, request); err != nil {
+			return nil, err
+		}
+	}
+	tracker := newRunTracker(compiled, runID)
+	tracker.events = onEvent
+	return fexec.run(compiled, runID, request, nil, tracker)
+}
+
+// Stream starts the workflow in the background like Start and returns a
+// channel of the events of the run, closed once the run finishes. The
+// result is then read with Wait or Result.
+func (fexec *FlowExecutor) Stream(request []byte) (string, <-chan *Event, error) {
+	compiled, err := fexec.compile()
+	if err != nil {
+		return "", nil, err
+	}
+	// every node starts and finishes at most once, so the run never waits
+	// for the reader
+	events := make(chan *Event, 2*len(compiled.order))
+	runID, err := fexec.start(compiled, request, func(event *Event) {
+		events <- event
+	}, func() {
+		close(events)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return runID, events, nil
+}
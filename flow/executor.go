@@ -1,8 +1,9 @@
 package flow
 
 import (
-	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
@@ -16,8 +17,52 @@ import (
 
 type FlowExecutor struct {
 	Flow *Workflow
-	Ctx  context.Context
-	wg   sync.WaitGroup
+	// Compiled is the snapshot of the workflow that every run executes,
+	// taken with Workflow.Compile. When nil Flow is compiled for every run,
+	// so that runs see the changes made to Flow.
+	Compiled *CompiledFlow
+	Ctx      context.Context
+	// FailureMode decides what happens to the running nodes once a node fails
+	FailureMode FailureMode
+	// Checkpoints records the progress of every run when set, so that an
+	// interrupted run can be resumed
+	Checkpoints CheckpointStore
+	// Listeners are told about the start and end of every run, node and
+	// operation
+	Listeners []Listener
+	// Interceptors wrap the operation calls of every node
+	Interceptors []Interceptor
+
+	// runs holds the runs started with Start
+	mu   sync.Mutex
+	runs map[string]*runTracker
+}
+
+type FailureMode int
+
+const (
+	// WaitForRunning stops dispatching nodes after a failure and waits for
+	// the nodes already running
+	WaitForRunning FailureMode = iota
+	// FailFast cancels the nodes already running on the first failure
+	FailFast
+)
+
+// RunResult is the outcome of a successful run
+type RunResult struct {
+	RunId string
+	// Output is the JSON result of the workflow
+	Output []byte
+	// Skipped lists the nodes that were not executed because none of their
+	// inbound edges was followed
+	Skipped []string
+	// Cancelled lists the nodes stopped because the nodes waiting for them
+	// had already reached their join quorum
+	Cancelled []string
+	// Branches holds the branch selected by every choice node that ran
+	Branches map[string]string
+	// Errors lists the failures of nodes that continue on error
+	Errors []*NodeError
 }
 
 type RawRequest struct {
@@ -29,14 +74,14 @@ type RawRequest struct {
 
 type task struct {
 	request      []byte
-	node         *sdk.Node
+	node         *compiledNode
 	options      map[string]interface{}
-	parentResult *simplejson.Json
-}
-
-type Bolt struct {
-	value []byte `json:"value"`
-	name  string `json:"name"`
+	store        *runStore
+	runID        string
+	listeners    listeners
+	interceptors []Interceptor
+	// compensating is set for the task undoing a node
+	compensating bool
 }
 
 func parseIntOrDurationValue(val string, fallback time.Duration) time.Duration {
@@ -54,46 +99,86 @@ func parseIntOrDurationValue(val string, fallback time.Duration) time.Duration {
 	return duration
 }
 
-func worker(ctx context.Context, wg *sync.WaitGroup, nodeId string, tasks chan *task, taskReturns chan *simplejson.Json, errs chan error) {
-	defer wg.Done()
+func worker(ctx context.Context, task *task, results chan<- *nodeResult) {
+	nodeResult := &nodeResult{node: task.node}
+	// a panic of the node fails the node instead of the process
+	panicked := func(err *PanicError) {
+		task.logf("Node `%s` panicked, %v\n%s", task.node.id, err.Value, err.Stack)
+		nodeResult.output = nil
+		nodeResult.err = asNodeError(task.node.id, err)
+	}
+	defer func() {
+		if value := recover(); value != nil {
+			panicked(recovered(value))
+		}
+		results <- nodeResult
+	}()
 	var sendErr = func(err error) bool {
 		if err == nil {
 			return false
 		}
-		fmt.Println(err.Error())
-		errs <- err
+		nodeResult.err = asNodeError(task.node.id, err)
 		return true
 	}
-	task, ok := <-tasks
-	if !ok {
-		fmt.Println("Worker: ", nodeId, " : Shutting Down")
-		return
-	}
 	var result []byte
 	var err error
-	global, _ := simplejson.NewJson(task.request)
-	input, output := task.node.Offer()
+	input, output := task.node.inputs, task.node.outputs
 	if len(input) > 0 {
 		inputMap := simplejson.New()
 		for _, v := range input {
-			if inputv, ok := global.CheckGet(v); ok {
+			if inputv, ok := task.store.resolve(task.node, v); ok {
 				inputMap.Set(v, inputv)
 			}
-			if resultv, ok := task.parentResult.CheckGet(v); ok {
-				inputMap.Set(v, resultv)
-			}
 		}
 		result, err = inputMap.MarshalJSON()
 		if ok := sendErr(err); ok {
 			return
 		}
+		nodeResult.input = result
 	}
-	for _, operation := range task.node.Operations() {
-		if result == nil {
-			result, err = operation.Execute(ctx, task.request, task.options)
-		} else {
-			result, err = operation.Execute(ctx, result, task.options)
+	info := task.nodeInfo()
+	info.InputSize = len(result)
+	if result == nil {
+		info.InputSize = len(task.request)
+	}
+	task.listeners.nodeStart(info)
+	start := time.Now()
+	defer func() {
+		if value := recover(); value != nil {
+			panicked(recovered(value))
+		}
+		info.Duration = time.Since(start)
+		info.OutputSize = len(result)
+		info.Err = nodeResult.err
+		task.listeners.nodeEnd(info)
+	}()
+
+	nodeCtx := ctx
+	if task.node.timeout > 0 {
+		var cancel context.CancelFunc
+		nodeCtx, cancel = context.WithTimeout(ctx, task.node.timeout)
+		defer cancel()
+	}
+	iterate := func(iterationCtx context.Context, data []byte) ([]byte, error) {
+		if task.node.forEach != nil {
+			return task.node.forEach.run(iterationCtx, ctx, task, data)
+		}
+		return runOperations(iterationCtx, ctx, task, data)
+	}
+	if task.node.loop != nil {
+		result, err = task.node.loop.run(nodeCtx, task, result, iterate)
+	} else {
+		result, err = iterate(nodeCtx, result)
+	}
+	if ok := sendErr(err); ok {
+		return
+	}
+	if task.node.choice != nil {
+		selected := result
+		if selected == nil {
+			selected = task.request
 		}
+		nodeResult.branch, nodeResult.route, err = task.node.choice.route(task.node.id, selected)
 		if ok := sendErr(err); ok {
 			return
 		}
@@ -109,13 +194,118 @@ func worker(ctx context.Context, wg *sync.WaitGroup, nodeId string, tasks chan *
 				lastResult.Set(key, value)
 			}
 		}
-		taskReturns <- lastResult
+		nodeResult.output = lastResult
+	}
+}
+
+// runOperations runs the operation chain of the node on data, the chain
+// starts from the global request when the node takes no input
+func runOperations(nodeCtx, ctx context.Context, task *task, data []byte) ([]byte, error) {
+	result := data
+	var err error
+	for _, operation := range task.node.operations {
+		input := result
+		if input == nil {
+			input = task.request
+		}
+		info := &OperationInfo{
+			RunId:       task.runID,
+			RequestId:   fmt.Sprint(task.options["request-id"]),
+			NodeId:      task.node.id,
+			OperationId: operation.GetId(),
+			InputSize:   len(input),
+		}
+		task.listeners.operationStart(info)
+		start := time.Now()
+		result, err = task.invoke(nodeCtx, operation, input)
+		info.Duration = time.Since(start)
+		info.OutputSize = len(result)
+		info.Err = err
+		task.listeners.operationEnd(info)
+		if err != nil {
+			return nil, newNodeError(task.node.id, operation.GetId(), nodeTimeoutErr(task.node, operation, err, nodeCtx, ctx))
+		}
+	}
+	return result, nil
+}
+
+// nodeTimeoutErr names the node in an operation timeout, and turns an error
+// caused by the node's own deadline into a TimeoutError
+func nodeTimeoutErr(node *compiledNode, operation sdk.Operation, err error, nodeCtx, ctx context.Context) error {
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		timeoutErr.NodeId = node.id
+		return timeoutErr
+	}
+	if node.timeout > 0 && nodeCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		return &TimeoutError{NodeId: node.id, OperationId: operation.GetId(), Level: "node", Timeout: node.timeout}
+	}
+	return err
+}
+
+// compile returns the compiled snapshot of the executor, or compiles its
+// workflow as it is now
+func (fexec *FlowExecutor) compile() (*CompiledFlow, error) {
+	if fexec.Compiled != nil {
+		return fexec.Compiled, nil
+	}
+	if fexec.Flow == nil {
+		return nil, errors.New("executor has no workflow")
 	}
+	return fexec.Flow.Compile()
 }
 
 func (fexec *FlowExecutor) ExecuteFlow(request []byte) ([]byte, error) {
+	result, err := fexec.Execute(request)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Errors) > 0 {
+		return result.Output, &PartialError{Errors: result.Errors}
+	}
+	return result.Output, nil
+}
+
+// Execute runs the workflow and reports the result together with the
+// details of the run, a failed run still reports its RunId
+func (fexec *FlowExecutor) Execute(request []byte) (*RunResult, error) {
+	return fexec.ExecuteRun(newRunID(), request)
+}
+
+// ExecuteRun runs the workflow under a run id chosen by the caller, which
+// can keep the id to resume the run after a restart
+func (fexec *FlowExecutor) ExecuteRun(runID string, request []byte) (*RunResult, error) {
+	compiled, err := fexec.compile()
+	if err != nil {
+		return nil, err
+	}
+	if fexec.Checkpoints != nil {
+		if err := fexec.Checkpoints.SaveRun(runID, request); err != nil {
+			return nil, err
+		}
+	}
+	return fexec.run(compiled, runID, request, nil, nil)
+}
+
+// Resume continues an interrupted run from the checkpoint store, the nodes
+// that had finished are not executed again
+func (fexec *FlowExecutor) Resume(runID string) (*RunResult, error) {
+	if fexec.Checkpoints == nil {
+		return nil, errors.New("executor has no checkpoint store")
+	}
+	compiled, err := fexec.compile()
+	if err != nil {
+		return nil, err
+	}
+	request, checkpoints, err := fexec.Checkpoints.Load(runID)
+	if err != nil {
+		return nil, err
+	}
+	return fexec.run(compiled, runID, request, checkpoints, nil)
+}
+
+func (fexec *FlowExecutor) run(compiled *CompiledFlow, runID string, request []byte, checkpoints []*NodeCheckpoint, tracker *runTracker) (*RunResult, error) {
 	globalReq, _ := simplejson.NewJson(request)
-	parentResult := simplejson.New()
 
 	options := make(map[string]interface{})
 	options["gateway"] = os.Getenv("gateway")
@@ -126,75 +316,63 @@ func (fexec *FlowExecutor) ExecuteFlow(request []byte) ([]byte, error) {
 		options["request-id"] = os.Getenv("request-id")
 	}
 
+	ctx := fexec.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
 	readTimeout := parseIntOrDurationValue(os.Getenv("read_timeout"), 10*time.Second)
-	fmt.Println(readTimeout)
-	workerCtx, workerCancel := context.WithTimeout(fexec.Ctx, readTimeout)
+	workerCtx, workerCancel := context.WithTimeout(ctx, readTimeout)
 	defer workerCancel()
 
-	workflow := fexec.Flow
-	for workflow.GetNodeLeft() != 0 {
-		startNodes := workflow.GetStartNodes()
-
-		nodeSize := startNodes.Len()
-		taskCh := make(chan *task, nodeSize)
-		taskReturnCh := make(chan *simplejson.Json, nodeSize)
-		errCh := make(chan error, nodeSize)
-
-		startNodeIds := make([]string, 0)
-
-		fexec.wg.Add(nodeSize)
-
-		for item := startNodes.Front(); nil != item; item = item.Next() {
-			node := item.Value.(*sdk.Node)
-			startNodeIds = append(startNodeIds, node.Id)
-			go worker(workerCtx, &fexec.wg, node.Id, taskCh, taskReturnCh, errCh)
-		}
+	run := newFlowRun(compiled, request, options)
+	run.failFast = fexec.FailureMode == FailFast
+	run.compensationTimeout = readTimeout
+	run.runID = runID
+	run.checkpoints = fexec.Checkpoints
+	run.tracker = tracker
+	run.listeners = fexec.Listeners
+	run.interceptors = fexec.Interceptors
+	if err := run.restore(checkpoints); err != nil {
+		return nil, err
+	}
 
-		for item := startNodes.Front(); nil != item; item = item.Next() {
-			node := item.Value.(*sdk.Node)
-			nodeTask := task{
-				node:         node,
-				request:      request,
-				options:      options,
-				parentResult: parentResult,
-			}
-			taskCh <- &nodeTask
-		}
-		fexec.wg.Wait()
-		close(taskCh)
-		workflow.RemoveExec(startNodeIds)
+	info := &RunInfo{RunId: runID, RequestId: fmt.Sprint(options["request-id"]), InputSize: len(request)}
+	run.listeners.runStart(info)
+	start := time.Now()
+	result, err := run.execute(workerCtx)
+	info.Duration = time.Since(start)
+	info.Err = err
+	if result != nil {
+		info.OutputSize = len(result.Output)
+	}
+	run.listeners.runEnd(info)
+	if err != nil {
+		return &RunResult{RunId: runID}, err
+	}
+	if fexec.Checkpoints != nil {
+		fexec.Checkpoints.Delete(runID)
+	}
+	return result, nil
+}
 
-		err := handleErr(errCh)
-		if err != nil {
-			return nil, err
-		}
-		parentResult = display(taskReturnCh)
+// newRunID returns a random id for a run
+func newRunID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
 	}
-	return parentResult.MarshalJSON()
+	return hex.EncodeToString(id)
 }
 
-func display(results chan *simplejson.Json) *simplejson.Json {
-	close(results)
+func display(results []*simplejson.Json) *simplejson.Json {
 	data := simplejson.New()
-	for result := range results {
+	for _, result := range results {
+		if result == nil {
+			continue
+		}
 		for _, key := range result.Keys() {
 			data.Set(key, result.Get(key))
 		}
 	}
 	return data
 }
-
-func handleErr(errs chan error) error {
-	close(errs)
-	if len(errs) == 0 {
-		return nil
-	}
-	var buffer bytes.Buffer
-	buffer.WriteString("[")
-	for err := range errs {
-		buffer.WriteString(err.Error())
-		buffer.WriteString(",")
-	}
-	buffer.WriteString("]")
-	return errors.New(buffer.String())
-}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 )
 
 type FaasOperation struct {
@@ -19,8 +20,10 @@ type FaasOperation struct {
 	Mod            Modifier // Modifier
 
 	// Optional Options
-	Header map[string]string   // The HTTP call header
-	Param  map[string][]string // The Parameter in Query string
+	Header  map[string]string   // The HTTP call header
+	Param   map[string][]string // The Parameter in Query string
+	Timeout time.Duration       // The timeout of a single attempt
+	Retry   *RetryPolicy        // The retry policy of Function and HttpRequest
 
 	FailureHandler FuncErrorHandler // The Failure handler of the operation
 	Requesthandler ReqHandler       // The http request handler of the operation
@@ -40,8 +43,10 @@ func (operation *FaasOperation) GetId() string {
 	switch {
 	case operation.Function != "":
 		id = operation.Function
-	case operation.HttpRequestUrl != "":
+	case len(operation.HttpRequestUrl) > 16:
 		id = "http-req-" + operation.HttpRequestUrl[len(operation.HttpRequestUrl)-16:]
+	case operation.HttpRequestUrl != "":
+		id = "http-req-" + operation.HttpRequestUrl
 	}
 	return id
 }
@@ -82,18 +87,23 @@ func (operation *FaasOperation) Execute(ctx context.Context, data []byte, option
 	var result []byte
 	var err error
 
-	reqId := fmt.Sprintf("%v", option["request-id"])
 	gateway := fmt.Sprintf("%v", option["gateway"])
 
 	switch {
 	// If function
 	case operation.Function != "":
-		fmt.Printf("[Request `%s`] Executing function `%s`\n",
-			reqId, operation.Function)
-		result, err = executeFunction(ctx, gateway, operation, data)
+		var attempts int
+		result, attempts, err = operation.call(ctx, func(ctx context.Context) ([]byte, error) {
+			return executeFunction(ctx, gateway, operation, data)
+		})
 		if err != nil {
-			err = fmt.Errorf("Function(%s), error: function execution failed, %v",
-				operation.Function, err)
+			if _, ok := err.(*TimeoutError); !ok {
+				err = &callError{
+					message:  fmt.Sprintf("Function(%s), error: function execution failed", operation.Function),
+					attempts: attempts,
+					err:      err,
+				}
+			}
 			if operation.FailureHandler != nil {
 				err = operation.FailureHandler(err)
 			}
@@ -104,12 +114,18 @@ func (operation *FaasOperation) Execute(ctx context.Context, data []byte, option
 
 	// If httpRequest
 	case operation.HttpRequestUrl != "":
-		fmt.Printf("[Request `%s`] Executing httpRequest `%s`\n",
-			reqId, operation.HttpRequestUrl)
-		result, err = executeHttpRequest(ctx, operation, data)
+		var attempts int
+		result, attempts, err = operation.call(ctx, func(ctx context.Context) ([]byte, error) {
+			return executeHttpRequest(ctx, operation, data)
+		})
 		if err != nil {
-			err = fmt.Errorf("HttpRequest(%s), error: httpRequest failed, %v",
-				operation.HttpRequestUrl, err)
+			if _, ok := err.(*TimeoutError); !ok {
+				err = &callError{
+					message:  fmt.Sprintf("HttpRequest(%s), error: httpRequest failed", operation.HttpRequestUrl),
+					attempts: attempts,
+					err:      err,
+				}
+			}
 			if operation.FailureHandler != nil {
 				err = operation.FailureHandler(err)
 			}
@@ -122,25 +138,145 @@ func (operation *FaasOperation) Execute(ctx context.Context, data []byte, option
 		}
 	// If modifier
 	default:
-		fmt.Printf("[Request `%s`] Executing modifier\n", reqId)
-		result, err = operation.Mod(data)
-		if err != nil {
-			err = fmt.Errorf("error: Failed at modifier, %v", err)
+		parent := ctx
+		if operation.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, operation.Timeout)
+			defer cancel()
+		}
+		result, err = operation.modify(ctx, data)
+		if err != nil && err == ctx.Err() {
+			if timeoutErr := operation.timeoutErr(ctx, parent); timeoutErr != nil {
+				return nil, timeoutErr
+			}
 			return nil, err
 		}
+		if err != nil {
+			return nil, &ModifierError{Err: err}
+		}
 		if result == nil {
 			result = []byte("")
 		}
-		select {
-		case <-ctx.Done():
-			fmt.Printf("Why? %s\n", ctx.Err())
-			return nil, ctx.Err()
-		default:
+	}
 
+	return result, nil
+}
+
+// call runs an http call, each attempt bounded by the operation timeout and
+// failed attempts retried according to the retry policy
+func (operation *FaasOperation) call(ctx context.Context, call func(context.Context) ([]byte, error)) ([]byte, int, error) {
+
+	maxAttempts := 1
+	if operation.Retry != nil && operation.Retry.MaxAttempts > 1 {
+		maxAttempts = operation.Retry.MaxAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		result, err := operation.attempt(ctx, call)
+		if err == nil {
+			return result, attempt, nil
+		}
+		if attempt >= maxAttempts || !operation.Retry.retryable(err) {
+			return result, attempt, err
+		}
+		backoff := operation.Retry.backoff(attempt)
+		if run, ok := ctx.Value(runKey{}).(*flowRun); ok {
+			run.logf("", "Retrying `%s` in %s (attempt %d/%d), %v",
+				operation.GetId(), backoff, attempt+1, maxAttempts, err)
+		}
+		if !operation.Retry.wait(ctx, backoff) {
+			return result, attempt, err
 		}
 	}
+}
 
-	return result, nil
+func (operation *FaasOperation) attempt(ctx context.Context, call func(context.Context) ([]byte, error)) ([]byte, error) {
+	parent := ctx
+	if operation.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, operation.Timeout)
+		defer cancel()
+	}
+	result, err := call(ctx)
+	if err != nil {
+		if timeoutErr := operation.timeoutErr(ctx, parent); timeoutErr != nil {
+			return result, timeoutErr
+		}
+	}
+	return result, err
+}
+
+// attemptsNote describes the number of attempts in an error once retried
+func attemptsNote(attempts int) string {
+	if attempts <= 1 {
+		return ""
+	}
+	return fmt.Sprintf(" after %d attempts", attempts)
+}
+
+// modify runs the modifier and gives up waiting for it once ctx is done
+func (operation *FaasOperation) modify(ctx context.Context, data []byte) ([]byte, error) {
+	type modResult struct {
+		data []byte
+		err  error
+	}
+	done := make(chan modResult, 1)
+	go func() {
+		result, err := protect(func() ([]byte, error) {
+			return operation.Mod(data)
+		})
+		done <- modResult{data: result, err: err}
+	}()
+	select {
+	case res := <-done:
+		return res.data, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// timeoutErr returns a TimeoutError when the operation's own deadline expired
+// while the context it was given is still alive
+func (operation *FaasOperation) timeoutErr(ctx, parent context.Context) error {
+	if operation.Timeout > 0 && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+		return &TimeoutError{OperationId: operation.GetId(), Level: "operation", Timeout: operation.Timeout}
+	}
+	return nil
+}
+
+// applyOptions applies the operation options given to Apply, Request or Modify
+func (operation *FaasOperation) applyOptions(opts []Option) {
+	o := &Options{}
+	for _, opt := range opts {
+		o.reset()
+		opt(o)
+		if len(o.header) != 0 {
+			for key, value := range o.header {
+				operation.addheader(key, value)
+			}
+		}
+		if len(o.query) != 0 {
+			for key, array := range o.query {
+				for _, value := range array {
+					operation.addparam(key, value)
+				}
+			}
+		}
+		if o.failureHandler != nil {
+			operation.addFailureHandler(o.failureHandler)
+		}
+		if o.responseHandler != nil {
+			operation.addResponseHandler(o.responseHandler)
+		}
+		if o.requestHandler != nil {
+			operation.addRequestHandler(o.requestHandler)
+		}
+		if o.timeout > 0 {
+			operation.Timeout = o.timeout
+		}
+		if o.retry != nil {
+			operation.Retry = o.retry
+		}
+	}
 }
 
 func (operation *FaasOperation) addheader(key string, value string) {
@@ -196,6 +332,16 @@ func makeQueryStringFromParam(params map[string][]string) string {
 	return result
 }
 
+// copyHeaders copies the operation headers so that concurrent runs never
+// write to the shared operation definition
+func copyHeaders(headers map[string]string) map[string]string {
+	result := make(map[string]string, len(headers)+1)
+	for key, value := range headers {
+		result[key] = value
+	}
+	return result
+}
+
 // buildHttpRequest build upstream request for function
 func buildHttpRequest(url string, method string, data []byte, params map[string][]string,
 	headers map[string]string) (*http.Request, error) {
@@ -224,7 +370,10 @@ func executeFunction(ctx context.Context, gateway string, operation *FaasOperati
 
 	name := operation.Function
 	params := operation.GetParams()
-	headers := operation.GetHeaders()
+	headers := copyHeaders(operation.GetHeaders())
+	for key, value := range contextHeaders(ctx) {
+		headers[key] = value
+	}
 
 	funcUrl := buildURL("http://"+gateway, "function", name)
 
@@ -259,8 +408,8 @@ func executeFunction(ctx context.Context, gateway string, operation *FaasOperati
 		result, err = operation.OnResphandler(resp)
 	} else {
 		if resp.StatusCode < 200 || resp.StatusCode > 299 {
-			err = fmt.Errorf("invalid return status %d while connecting %s", resp.StatusCode, funcUrl)
 			result, _ = ioutil.ReadAll(resp.Body)
+			err = newStatusError(resp.StatusCode, funcUrl, result)
 		} else {
 			result, err = ioutil.ReadAll(resp.Body)
 		}
@@ -276,7 +425,10 @@ func executeHttpRequest(ctx context.Context, operation *FaasOperation, data []by
 
 	httpUrl := operation.HttpRequestUrl
 	params := operation.GetParams()
-	headers := operation.GetHeaders()
+	headers := copyHeaders(operation.GetHeaders())
+	for key, value := range contextHeaders(ctx) {
+		headers[key] = value
+	}
 
 	method := os.Getenv("default-method")
 	if method == "" {
@@ -309,8 +461,8 @@ func executeHttpRequest(ctx context.Context, operation *FaasOperation, data []by
 		_, err = operation.OnResphandler(resp)
 	} else {
 		if resp.StatusCode < 200 || resp.StatusCode > 299 {
-			err = fmt.Errorf("invalid return status %d while connecting %s", resp.StatusCode, httpUrl)
 			result, _ = ioutil.ReadAll(resp.Body)
+			err = newStatusError(resp.StatusCode, httpUrl, result)
 		} else {
 			result, err = ioutil.ReadAll(resp.Body)
 		}
@@ -331,6 +483,8 @@ func createFunction(name string) *FaasOperation {
 func createModifier(mod Modifier) *FaasOperation {
 	operation := &FaasOperation{}
 	operation.Mod = mod
+	operation.Header = make(map[string]string)
+	operation.Param = make(map[string][]string)
 	return operation
 }
 
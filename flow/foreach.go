@@ -0,0 +1,147 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/dafanshu/simplejson"
+)
+
+// forEach fans the operation chain of a node out over the elements of an
+// array input
+type forEach struct {
+	key         string
+	concurrency int
+	errorsKey   string
+}
+
+type ForEachOption func(*forEach)
+
+// Concurrency limits the number of elements processed at the same time
+func Concurrency(limit int) ForEachOption {
+	return func(each *forEach) {
+		each.concurrency = limit
+	}
+}
+
+// CollectErrors keeps going when an element fails: its result is null and
+// the error is listed as {"index", "error"} under errorsKey, which becomes
+// an output of the node. By default the first failing element fails the
+// node and stops the others.
+func CollectErrors(errorsKey string) ForEachOption {
+	return func(each *forEach) {
+		each.errorsKey = errorsKey
+	}
+}
+
+// ForEach runs the operation chain of the node once for every element of
+// the array under key, in parallel, and writes the results in order as an
+// array to the first Out key of the node
+func (node *Node) ForEach(key string, opts ...ForEachOption) *Node {
+	each := &forEach{key: key}
+	for _, opt := range opts {
+		opt(each)
+	}
+	node.spec.forEach = each
+	return node
+}
+
+func (each *forEach) run(nodeCtx, ctx context.Context, task *task, data []byte) ([]byte, error) {
+	if data == nil {
+		data = task.request
+	}
+	input, err := simplejson.NewJson(data)
+	if err != nil {
+		return nil, fmt.Errorf("foreach node %s: %v", task.node.id, err)
+	}
+	items, err := input.Get(each.key).Array()
+	if err != nil {
+		return nil, fmt.Errorf("foreach node %s: %q is not an array", task.node.id, each.key)
+	}
+
+	concurrency := each.concurrency
+	if concurrency <= 0 || concurrency > len(items) {
+		concurrency = len(items)
+	}
+	elementCtx, cancel := context.WithCancel(nodeCtx)
+	defer cancel()
+
+	results := make([]interface{}, len(items))
+	errs := make([]error, len(items))
+	var firstErr error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, concurrency)
+	for i, item := range items {
+		select {
+		case slots <- struct{}{}:
+		case <-elementCtx.Done():
+			errs[i] = elementCtx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(i int, item interface{}) {
+			defer wg.Done()
+			defer func() {
+				<-slots
+			}()
+			element, err := json.Marshal(item)
+			if err == nil {
+				element, err = protect(func() ([]byte, error) {
+					return runOperations(elementCtx, ctx, task, element)
+				})
+			}
+			if err != nil {
+				errs[i] = err
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("foreach node %s: element %d: %w", task.node.id, i, err)
+				}
+				mu.Unlock()
+				if each.errorsKey == "" {
+					cancel()
+				}
+				return
+			}
+			results[i] = decodeElement(element)
+		}(i, item)
+	}
+	wg.Wait()
+
+	// the elements failed because the node itself timed out or was
+	// cancelled, this fails the node even when errors are collected
+	if err := nodeCtx.Err(); err != nil {
+		if len(task.node.operations) > 0 {
+			err = nodeTimeoutErr(task.node, task.node.operations[0], err, nodeCtx, ctx)
+		}
+		return nil, fmt.Errorf("foreach node %s: %w", task.node.id, err)
+	}
+
+	output := simplejson.New()
+	output.Set(task.node.outputs[0], results)
+	if each.errorsKey == "" {
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return output.MarshalJSON()
+	}
+	failures := make([]map[string]interface{}, 0)
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, map[string]interface{}{"index": i, "error": err.Error()})
+		}
+	}
+	output.Set(each.errorsKey, failures)
+	return output.MarshalJSON()
+}
+
+// decodeElement keeps the JSON result of an element as a value, anything
+// else as a string
+func decodeElement(data []byte) interface{} {
+	if result, err := simplejson.NewJson(data); err == nil {
+		return result.Interface()
+	}
+	return string(data)
+}
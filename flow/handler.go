@@ -1,6 +1,10 @@
 package flow
 
-import "net/http"
+import (
+	"net/http"
+
+	"github.com/dafanshu/simplejson"
+)
 
 // FuncErrorHandler the error handler for OnFailure() options
 type FuncErrorHandler func(error) error
@@ -13,3 +17,11 @@ type RespHandler func(*http.Response) ([]byte, error)
 
 // Reqhandler definition for RequestHdlr() option on operation
 type ReqHandler func(*http.Request)
+
+// Condition definition for EdgeIf() call, it receives the outputs of the
+// edge's source node
+type Condition func(*simplejson.Json) bool
+
+// Selector definition for Switch() call, it receives the result of the
+// choice node and returns the name of the branch to activate
+type Selector func([]byte) (string, error)
@@ -0,0 +1,89 @@
+package flow
+
+import (
+	"context"
+	"strings"
+
+	"github.com/dafanshu/mini-flow/sdk"
+)
+
+// Invoker calls the next interceptor of the chain, the last one calls the
+// operation itself
+type Invoker func(ctx context.Context, data []byte) ([]byte, error)
+
+// Interceptor wraps every call of an operation. It can inspect or rewrite
+// the payload and the result, return without calling next to short-circuit
+// the operation, or decorate the error it returns.
+type Interceptor func(ctx context.Context, call *OperationCall, data []byte, next Invoker) ([]byte, error)
+
+// OperationCall describes the operation an interceptor wraps
+type OperationCall struct {
+	RunId     string
+	RequestId string
+	NodeId    string
+	Operation sdk.Operation
+	// Compensation is set when the operation undoes the node after the run
+	// failed
+	Compensation bool
+}
+
+// Use registers interceptors wrapping the operations of every node, the
+// first one registered is the outermost
+func (fexec *FlowExecutor) Use(interceptors ...Interceptor) *FlowExecutor {
+	fexec.Interceptors = append(fexec.Interceptors, interceptors...)
+	return fexec
+}
+
+// Intercept registers interceptors wrapping the operations of the node, they
+// run inside the interceptors of the executor
+func (node *Node) Intercept(interceptors ...Interceptor) *Node {
+	node.spec.interceptors = append(node.spec.interceptors, interceptors...)
+	return node
+}
+
+// invoke calls the operation through the interceptors of the executor and
+// of the node
+func (task *task) invoke(ctx context.Context, operation sdk.Operation, data []byte) ([]byte, error) {
+	chain := make([]Interceptor, 0, len(task.interceptors)+len(task.node.interceptors))
+	chain = append(append(chain, task.interceptors...), task.node.interceptors...)
+	if len(chain) == 0 {
+		return operation.Execute(ctx, data, task.options)
+	}
+	call := &OperationCall{
+		RunId:        task.runID,
+		RequestId:    task.nodeInfo().RequestId,
+		NodeId:       task.node.id,
+		Operation:    operation,
+		Compensation: task.compensating,
+	}
+	var next func(i int) Invoker
+	next = func(i int) Invoker {
+		if i == len(chain) {
+			return func(ctx context.Context, data []byte) ([]byte, error) {
+				return operation.Execute(ctx, data, task.options)
+			}
+		}
+		return func(ctx context.Context, data []byte) ([]byte, error) {
+			return chain[i](ctx, call, data, next(i+1))
+		}
+	}
+	return next(0)(ctx, data)
+}
+
+type headerKey struct{}
+
+// WithHeader returns a context adding an http header to the function and
+// http calls made with it, for an interceptor to pass to next
+func WithHeader(ctx context.Context, key, value string) context.Context {
+	headers := make(map[string]string)
+	for k, v := range contextHeaders(ctx) {
+		headers[k] = v
+	}
+	headers[strings.ToLower(key)] = value
+	return context.WithValue(ctx, headerKey{}, headers)
+}
+
+func contextHeaders(ctx context.Context) map[string]string {
+	headers, _ := ctx.Value(headerKey{}).(map[string]string)
+	return headers
+}
@@ -0,0 +1,31 @@
+package flow
+
+// Join decides when a node with several predecessors runs
+type Join struct {
+	// quorum is the number of followed inbound edges the node waits for,
+	// zero waits for all predecessors
+	quorum int
+}
+
+var (
+	// JoinAll runs the node once all of its predecessors have finished
+	JoinAll = Join{}
+	// JoinAny runs the node as soon as its first predecessor succeeds
+	JoinAny = Join{quorum: 1}
+)
+
+// JoinQuorum runs the node as soon as n of its predecessors succeed
+func JoinQuorum(n int) Join {
+	return Join{quorum: n}
+}
+
+// Join sets the join policy of the node. When a node runs on a quorum, the
+// later predecessors are ignored and those still running are cancelled
+// unless another node waits for them. A predecessor feeding only quorum
+// nodes that fails while the quorum can still be reached does not fail the
+// run, its edge is just not followed. Its failure fails the run when the
+// quorum is missed after all.
+func (node *Node) Join(join Join) *Node {
+	node.spec.join = join
+	return node
+}
@@ -0,0 +1,167 @@
+package flow
+
+import (
+	"fmt"
+	"time"
+)
+
+// Listener observes the lifecycle of runs, for logging, metrics or
+// auditing. The node and operation callbacks are made from the goroutines
+// running the nodes, so a listener must be safe for concurrent use.
+type Listener interface {
+	OnRunStart(run *RunInfo)
+	OnNodeStart(node *NodeInfo)
+	OnOperationStart(operation *OperationInfo)
+	OnOperationEnd(operation *OperationInfo)
+	OnNodeEnd(node *NodeInfo)
+	OnRunEnd(run *RunInfo)
+}
+
+// BaseListener implements every callback of Listener as a no-op, a
+// listener embeds it and overrides the callbacks it needs
+type BaseListener struct{}
+
+func (BaseListener) OnRunStart(*RunInfo)             {}
+func (BaseListener) OnNodeStart(*NodeInfo)           {}
+func (BaseListener) OnOperationStart(*OperationInfo) {}
+func (BaseListener) OnOperationEnd(*OperationInfo)   {}
+func (BaseListener) OnNodeEnd(*NodeInfo)             {}
+func (BaseListener) OnRunEnd(*RunInfo)               {}
+
+// Logger is implemented by the listeners that also want the progress
+// messages of a run, such as restored, skipped, cancelled, retried or
+// compensated nodes. The messages are dropped when no listener wants them.
+type Logger interface {
+	OnLog(log *LogInfo)
+}
+
+// LogInfo is a progress message of a run, NodeId is empty for a message
+// not about a node
+type LogInfo struct {
+	RunId     string
+	RequestId string
+	NodeId    string
+	Message   string
+}
+
+// PrintLogger is a listener printing the progress messages of runs
+type PrintLogger struct {
+	BaseListener
+}
+
+func (PrintLogger) OnLog(log *LogInfo) {
+	fmt.Printf("[Request `%s`] %s\n", log.RequestId, log.Message)
+}
+
+// RunInfo describes a run, OutputSize, Duration and Err are set at its end
+type RunInfo struct {
+	RunId      string
+	RequestId  string
+	InputSize  int
+	OutputSize int
+	Duration   time.Duration
+	Err        error
+}
+
+// NodeInfo describes the execution of a node, OutputSize, Duration and Err
+// are set at its end
+type NodeInfo struct {
+	RunId      string
+	RequestId  string
+	NodeId     string
+	InputSize  int
+	OutputSize int
+	Duration   time.Duration
+	Err        error
+}
+
+// OperationInfo describes a call of an operation of a node, an operation
+// is called once per element of a foreach node and once per iteration of a
+// loop node
+type OperationInfo struct {
+	RunId       string
+	RequestId   string
+	NodeId      string
+	OperationId string
+	InputSize   int
+	OutputSize  int
+	Duration    time.Duration
+	Err         error
+}
+
+func (task *task) nodeInfo() *NodeInfo {
+	return &NodeInfo{
+		RunId:     task.runID,
+		RequestId: fmt.Sprint(task.options["request-id"]),
+		NodeId:    task.node.id,
+	}
+}
+
+// listeners fans the callbacks out to every listener of the executor
+type listeners []Listener
+
+func (ls listeners) runStart(run *RunInfo) {
+	for _, l := range ls {
+		l.OnRunStart(run)
+	}
+}
+
+func (ls listeners) runEnd(run *RunInfo) {
+	for _, l := range ls {
+		l.OnRunEnd(run)
+	}
+}
+
+func (ls listeners) nodeStart(node *NodeInfo) {
+	for _, l := range ls {
+		l.OnNodeStart(node)
+	}
+}
+
+func (ls listeners) nodeEnd(node *NodeInfo) {
+	for _, l := range ls {
+		l.OnNodeEnd(node)
+	}
+}
+
+func (ls listeners) operationStart(operation *OperationInfo) {
+	for _, l := range ls {
+		l.OnOperationStart(operation)
+	}
+}
+
+func (ls listeners) operationEnd(operation *OperationInfo) {
+	for _, l := range ls {
+		l.OnOperationEnd(operation)
+	}
+}
+
+func (ls listeners) log(log *LogInfo) {
+	for _, l := range ls {
+		if logger, ok := l.(Logger); ok {
+			logger.OnLog(log)
+		}
+	}
+}
+
+func (ls listeners) logf(runID string, options map[string]interface{}, nodeId, format string, args ...interface{}) {
+	if len(ls) == 0 {
+		return
+	}
+	ls.log(&LogInfo{
+		RunId:     runID,
+		RequestId: fmt.Sprint(options["request-id"]),
+		NodeId:    nodeId,
+		Message:   fmt.Sprintf(format, args...),
+	})
+}
+
+// logf reports a progress message of the run to its listeners
+func (run *flowRun) logf(nodeId, format string, args ...interface{}) {
+	run.listeners.logf(run.runID, run.options, nodeId, format, args...)
+}
+
+// logf reports a progress message of the node to the listeners of its run
+func (task *task) logf(format string, args ...interface{}) {
+	task.listeners.logf(task.runID, task.options, task.node.id, format, args...)
+}
@@ -0,0 +1,140 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dafanshu/simplejson"
+)
+
+// loop re-runs the operation chain of a node until its condition holds
+type loop struct {
+	until         Condition
+	expr          string
+	maxIterations int
+	maxDuration   time.Duration
+	interval      time.Duration
+}
+
+type LoopOption func(*loop)
+
+// MaxIterations bounds the number of iterations, 10 unless MaxDuration is set
+func MaxIterations(limit int) LoopOption {
+	return func(l *loop) {
+		l.maxIterations = limit
+	}
+}
+
+// MaxDuration bounds the time spent in the loop
+func MaxDuration(limit time.Duration) LoopOption {
+	return func(l *loop) {
+		l.maxDuration = limit
+	}
+}
+
+// Interval waits between two iterations
+func Interval(wait time.Duration) LoopOption {
+	return func(l *loop) {
+		l.interval = wait
+	}
+}
+
+// RepeatUntil re-runs the operation chain of the node until until holds on
+// its result, each iteration gets the result of the previous one as input.
+// The node fails when a bound is reached first. A sub-graph is repeated by
+// making it the SubFlow of the node.
+func (node *Node) RepeatUntil(until Condition, opts ...LoopOption) *Node {
+	node.spec.loop = newLoop(opts)
+	node.spec.loop.until = until
+	return node
+}
+
+// RepeatUntilExpr is RepeatUntil with a condition expression, see
+// ParseCondition
+func (node *Node) RepeatUntilExpr(expr string, opts ...LoopOption) *Node {
+	node.spec.loop = newLoop(opts)
+	node.spec.loop.expr = expr
+	return node
+}
+
+func newLoop(opts []LoopOption) *loop {
+	l := &loop{}
+	for _, opt := range opts {
+		opt(l)
+	}
+	if l.maxIterations <= 0 && l.maxDuration <= 0 {
+		l.maxIterations = 10
+	}
+	return l
+}
+
+// compile resolves the condition expression of the loop
+func (l *loop) compile() (*loop, error) {
+	compiled := *l
+	if compiled.expr != "" {
+		until, err := ParseCondition(compiled.expr)
+		if err != nil {
+			return nil, err
+		}
+		compiled.until = until
+	}
+	if compiled.until == nil {
+		return nil, fmt.Errorf("loop has no condition")
+	}
+	return &compiled, nil
+}
+
+func (l *loop) run(ctx context.Context, task *task, data []byte,
+	iterate func(context.Context, []byte) ([]byte, error)) ([]byte, error) {
+
+	loopCtx := ctx
+	if l.maxDuration > 0 {
+		var cancel context.CancelFunc
+		loopCtx, cancel = context.WithTimeout(ctx, l.maxDuration)
+		defer cancel()
+	}
+	expired := func() bool {
+		return l.maxDuration > 0 && loopCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+	}
+	notMet := func(iteration int) error {
+		if expired() {
+			return fmt.Errorf("loop node %s: condition not met within %s", task.node.id, l.maxDuration)
+		}
+		return fmt.Errorf("loop node %s: condition not met after %d iterations", task.node.id, iteration)
+	}
+
+	for iteration := 1; ; iteration++ {
+		result, err := iterate(loopCtx, data)
+		if err != nil {
+			if expired() {
+				return nil, notMet(iteration)
+			}
+			return nil, err
+		}
+		output, err := simplejson.NewJson(result)
+		if err != nil {
+			output = simplejson.New()
+		}
+		if l.until(output) {
+			return result, nil
+		}
+		if l.maxIterations > 0 && iteration >= l.maxIterations {
+			return nil, notMet(iteration)
+		}
+		task.logf("Repeating node `%s` (iteration %d)", task.node.id, iteration+1)
+		if l.interval > 0 {
+			timer := time.NewTimer(l.interval)
+			select {
+			case <-timer.C:
+			case <-loopCtx.Done():
+				timer.Stop()
+				if expired() {
+					return nil, notMet(iteration)
+				}
+				return nil, loopCtx.Err()
+			}
+		}
+		data = result
+	}
+}
@@ -0,0 +1,143 @@
+package flow
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Plan describes how a workflow runs, without invoking any operation
+type Plan struct {
+	// Stages holds the nodes of every stage, a node runs once the nodes of
+	// the earlier stages it depends on finished
+	Stages [][]*PlanNode
+}
+
+// PlanNode describes a node of a Plan
+type PlanNode struct {
+	NodeId     string
+	Stage      int
+	Operations []*PlanOperation
+	Inputs     []*PlanInput
+	Outputs    []string
+	Successors []string
+}
+
+// PlanOperation describes an operation of a node, URL is the address a
+// function or http operation calls
+type PlanOperation struct {
+	Id         string
+	Properties map[string][]string
+	URL        string
+}
+
+// PlanInput tells where an In key of a node is read from, Source is the
+// node producing it or empty for the global request
+type PlanInput struct {
+	Key    string
+	Source string
+}
+
+// Plan compiles the workflow and describes its stages, the operation chain
+// of every node and where the In keys of every node come from
+func (flow *Workflow) Plan() (*Plan, error) {
+	compiled, err := flow.Compile()
+	if err != nil {
+		return nil, err
+	}
+	gateway := os.Getenv("gateway")
+	plan := &Plan{}
+	for _, id := range compiled.order {
+		node := compiled.nodes[id]
+		planned := &PlanNode{
+			NodeId:     id,
+			Stage:      node.stage,
+			Outputs:    append([]string{}, node.outputs...),
+			Successors: append([]string{}, node.successors...),
+		}
+		for _, operation := range node.operations {
+			planOperation := &PlanOperation{Id: operation.GetId(), Properties: operation.GetProperties()}
+			if faas, ok := operation.(*FaasOperation); ok {
+				switch {
+				case faas.Function != "":
+					planOperation.URL = buildURL("http://"+gateway, "function", faas.Function) +
+						makeQueryStringFromParam(faas.Param)
+				case faas.HttpRequestUrl != "":
+					planOperation.URL = faas.HttpRequestUrl + makeQueryStringFromParam(faas.Param)
+				}
+			}
+			planned.Operations = append(planned.Operations, planOperation)
+		}
+		for _, key := range node.inputs {
+			planned.Inputs = append(planned.Inputs, &PlanInput{Key: key, Source: compiled.source(node, key)})
+		}
+		for len(plan.Stages) <= node.stage {
+			plan.Stages = append(plan.Stages, nil)
+		}
+		plan.Stages[node.stage] = append(plan.Stages[node.stage], planned)
+	}
+	return plan, nil
+}
+
+// source returns the node an In key of node is read from the way the run
+// store resolves it, or empty for the global request
+func (compiled *CompiledFlow) source(node *compiledNode, key string) string {
+	if producer, name, ok := compiled.splitRef(key); ok && node.hasAncestor(producer) {
+		if compiled.nodes[producer].provides(name) {
+			return producer
+		}
+		return ""
+	}
+	for _, ancestor := range node.ancestors {
+		if compiled.nodes[ancestor].provides(key) {
+			return ancestor
+		}
+	}
+	return ""
+}
+
+func (plan *Plan) String() string {
+	var builder strings.Builder
+	for stage, nodes := range plan.Stages {
+		fmt.Fprintf(&builder, "stage %d\n", stage)
+		for _, node := range nodes {
+			fmt.Fprintf(&builder, "  node %s\n", node.NodeId)
+			for _, operation := range node.Operations {
+				fmt.Fprintf(&builder, "    operation %s", operation.Id)
+				if operation.URL != "" {
+					fmt.Fprintf(&builder, " %s", operation.URL)
+				}
+				fmt.Fprintf(&builder, " %s\n", properties(operation.Properties))
+			}
+			for _, input := range node.Inputs {
+				source := input.Source
+				if source == "" {
+					source = "request"
+				}
+				fmt.Fprintf(&builder, "    in %s <- %s\n", input.Key, source)
+			}
+			if len(node.Outputs) > 0 {
+				fmt.Fprintf(&builder, "    out %s\n", strings.Join(node.Outputs, ", "))
+			}
+			if len(node.Successors) > 0 {
+				fmt.Fprintf(&builder, "    next %s\n", strings.Join(node.Successors, ", "))
+			}
+		}
+	}
+	return builder.String()
+}
+
+// properties formats the properties of an operation, sorted by name
+func properties(props map[string][]string) string {
+	names := make([]string, 0, len(props))
+	for name := range props {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, name+"="+strings.Join(props[name], ","))
+	}
+	return "{" + strings.Join(parts, " ") + "}"
+}
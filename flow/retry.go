@@ -0,0 +1,118 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/url"
+	"time"
+)
+
+// RetryPolicy configures how a Function or Request operation is retried
+type RetryPolicy struct {
+	MaxAttempts         int           // Attempts including the first one
+	InitialBackoff      time.Duration // Wait before the second attempt
+	MaxBackoff          time.Duration // Upper bound of a single wait
+	Multiplier          float64       // Growth of the wait per attempt
+	Jitter              float64       // Fraction of the wait that is randomised
+	RetryOnStatus       []int         // Response status codes that are retried
+	RetryOnNetworkError bool          // Retry connection errors and attempt timeouts
+}
+
+type RetryOption func(*RetryPolicy)
+
+// Retry retries a failed Function or Request operation up to maxAttempts
+// times in total, by default with an exponential backoff starting at 100ms,
+// on network errors and on 502, 503 and 504 responses
+func Retry(maxAttempts int, opts ...RetryOption) Option {
+	return func(o *Options) {
+		policy := &RetryPolicy{
+			MaxAttempts:         maxAttempts,
+			InitialBackoff:      100 * time.Millisecond,
+			MaxBackoff:          5 * time.Second,
+			Multiplier:          2,
+			Jitter:              0.2,
+			RetryOnStatus:       []int{502, 503, 504},
+			RetryOnNetworkError: true,
+		}
+		for _, opt := range opts {
+			opt(policy)
+		}
+		o.retry = policy
+	}
+}
+
+func Backoff(initial, max time.Duration, multiplier float64) RetryOption {
+	return func(policy *RetryPolicy) {
+		policy.InitialBackoff = initial
+		policy.MaxBackoff = max
+		policy.Multiplier = multiplier
+	}
+}
+
+func Jitter(fraction float64) RetryOption {
+	return func(policy *RetryPolicy) {
+		policy.Jitter = fraction
+	}
+}
+
+func RetryOnStatus(codes ...int) RetryOption {
+	return func(policy *RetryPolicy) {
+		policy.RetryOnStatus = codes
+	}
+}
+
+func RetryOnNetworkError(retry bool) RetryOption {
+	return func(policy *RetryPolicy) {
+		policy.RetryOnNetworkError = retry
+	}
+}
+
+// backoff returns the wait after the given failed attempt, counted from 1
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	multiplier := policy.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	wait := float64(policy.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if policy.MaxBackoff > 0 && wait > float64(policy.MaxBackoff) {
+		wait = float64(policy.MaxBackoff)
+	}
+	if policy.Jitter > 0 {
+		wait = wait * (1 - policy.Jitter + 2*policy.Jitter*rand.Float64())
+	}
+	return time.Duration(wait)
+}
+
+// retryable reports whether the error of an attempt is worth another one
+func (policy *RetryPolicy) retryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		for _, code := range policy.RetryOnStatus {
+			if code == statusErr.StatusCode {
+				return true
+			}
+		}
+		return false
+	}
+	var timeoutErr *TimeoutError
+	var urlErr *url.Error
+	return policy.RetryOnNetworkError && (errors.As(err, &timeoutErr) || errors.As(err, &urlErr))
+}
+
+// wait sleeps before the next attempt, it gives up when ctx is done or its
+// deadline would pass before the attempt could start
+func (policy *RetryPolicy) wait(ctx context.Context, backoff time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+		return false
+	}
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
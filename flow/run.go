@@ -0,0 +1,419 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/dafanshu/simplejson"
+)
+
+// flowRun holds the mutable state of a single execution of a CompiledFlow
+type flowRun struct {
+	flow     *CompiledFlow
+	request  []byte
+	options  map[string]interface{}
+	inDegree map[string]int
+	// followed counts the followed inbound edges of every node
+	followed map[string]int
+	// decided holds the nodes that were dispatched or skipped
+	decided   map[string]bool
+	skipped   map[string]bool
+	cancelled map[string]bool
+	// aborted holds the nodes cancelled by a fail-fast run
+	aborted map[string]bool
+	// failed holds the nodes that failed without failing the run
+	failed   map[string]bool
+	failures []*NodeError
+	// raced holds the failures of racers, they fail the run when a join
+	// they feed misses its quorum
+	raced map[string]*NodeError
+	// completed holds the succeeded nodes in completion order
+	completed           []*nodeResult
+	compensationTimeout time.Duration
+
+	runID       string
+	checkpoints CheckpointStore
+	// restored holds the results of nodes finished before a resume
+	restored map[string]*nodeResult
+	// tracker records the node states of a run that is followed with Status
+	// or with events
+	tracker   *runTracker
+	listeners listeners
+	// interceptors wrap the operation calls of every node
+	interceptors []Interceptor
+	cancels      map[string]context.CancelFunc
+	failFast     bool
+	branches     map[string]string
+	store        *runStore
+
+	ctx     context.Context
+	results chan *nodeResult
+	running int
+}
+
+// runKey holds the run executing a node in the context of the node, for a
+// sub workflow to inherit the settings of its parent run
+type runKey struct{}
+
+type nodeResult struct {
+	node   *compiledNode
+	input  []byte
+	output *simplejson.Json
+	// branch and route are the selected branch of a choice node and the
+	// node it routes to
+	branch string
+	route  string
+	err    error
+	// follows holds the edges to successors the node follows
+	follows map[string]bool
+	// restored is set for a result taken from a checkpoint
+	restored bool
+}
+
+func newFlowRun(compiled *CompiledFlow, request []byte, options map[string]interface{}) *flowRun {
+	run := &flowRun{
+		flow:                compiled,
+		request:             request,
+		options:             options,
+		inDegree:            make(map[string]int, len(compiled.nodes)),
+		followed:            make(map[string]int, len(compiled.nodes)),
+		decided:             make(map[string]bool, len(compiled.nodes)),
+		skipped:             make(map[string]bool),
+		cancelled:           make(map[string]bool),
+		aborted:             make(map[string]bool),
+		failed:              make(map[string]bool),
+		raced:               make(map[string]*NodeError),
+		cancels:             make(map[string]context.CancelFunc),
+		branches:            make(map[string]string),
+		store:               newRunStore(compiled, request),
+		restored:            make(map[string]*nodeResult),
+		compensationTimeout: 10 * time.Second,
+	}
+	for id, node := range compiled.nodes {
+		run.inDegree[id] = node.inDegree
+	}
+	return run
+}
+
+// execute dispatches every node as soon as all of its predecessors have
+// finished. Once a node fails no new node is dispatched, the nodes already
+// running are waited for and their errors are reported together. A
+// fail-fast run cancels the running nodes instead.
+func (run *flowRun) execute(ctx context.Context) (*RunResult, error) {
+	run.ctx = context.WithValue(ctx, runKey{}, run)
+	run.results = make(chan *nodeResult, len(run.flow.nodes))
+
+	for _, id := range run.flow.order {
+		if run.inDegree[id] == 0 {
+			run.dispatch(run.flow.nodes[id])
+		}
+	}
+
+	errs := make([]*NodeError, 0)
+	for run.running > 0 {
+		result := <-run.results
+		run.running--
+		run.cancels[result.node.id]()
+		delete(run.cancels, result.node.id)
+		if result.err == nil {
+			if result.follows, result.err = run.evaluate(result.node, result.output, result.route); result.err != nil {
+				result.output = nil
+			}
+		}
+		if result.err != nil && (run.cancelled[result.node.id] || run.aborted[result.node.id]) {
+			run.tracker.node(result.node.id, NodeCancelled, nil, result.err)
+			continue
+		}
+		if result.err != nil {
+			run.tracker.node(result.node.id, NodeFailed, nil, result.err)
+		}
+		if result.err != nil && result.node.continueOnError {
+			run.tolerate(result)
+			run.checkpoint(result)
+			var follows map[string]bool
+			if !run.failed[result.node.id] {
+				var err error
+				if follows, err = run.evaluate(result.node, result.output, ""); err != nil {
+					run.failed[result.node.id] = true
+				}
+			}
+			if len(errs) == 0 {
+				run.release(result.node, follows)
+			}
+			continue
+		}
+		if result.err != nil && run.racing(result.node) {
+			run.logf(result.node.id, "Node `%s` failed, its joins can still reach their quorum", result.node.id)
+			run.failed[result.node.id] = true
+			run.raced[result.node.id] = asNodeError(result.node.id, result.err)
+			if len(errs) == 0 {
+				run.release(result.node, nil)
+			}
+			continue
+		}
+		if result.err != nil {
+			errs = append(errs, asNodeError(result.node.id, result.err))
+			if run.failFast && len(errs) == 1 {
+				run.abort(result.node)
+			}
+			continue
+		}
+		delete(run.aborted, result.node.id)
+		run.tracker.node(result.node.id, NodeSucceeded, result.output, nil)
+		run.completed = append(run.completed, result)
+		run.checkpoint(result)
+		run.store.put(result.node.id, result.output)
+		if result.node.choice != nil {
+			run.branches[result.node.id] = result.branch
+		}
+		if len(errs) > 0 {
+			continue
+		}
+		run.release(result.node, result.follows)
+	}
+	errs = append(errs, run.racerErrors()...)
+	if len(errs) > 0 {
+		var err error = &MultiError{Errors: errs}
+		if len(run.aborted) > 0 {
+			err = &FailFastError{Cause: err, Cancelled: run.nodesIn(run.aborted)}
+		}
+		return nil, run.compensate(err)
+	}
+
+	result, err := run.result()
+	if err != nil {
+		return nil, run.compensate(err)
+	}
+	output, err := result.MarshalJSON()
+	if err != nil {
+		return nil, run.compensate(err)
+	}
+	return &RunResult{
+		RunId:     run.runID,
+		Output:    output,
+		Skipped:   run.nodesIn(run.skipped),
+		Cancelled: run.nodesIn(run.cancelled),
+		Branches:  run.branches,
+		Errors:    run.nodeErrors(),
+	}, nil
+}
+
+func (run *flowRun) dispatch(node *compiledNode) {
+	run.decided[node.id] = true
+	ctx, cancel := context.WithCancel(run.ctx)
+	run.cancels[node.id] = cancel
+	run.running++
+	run.tracker.node(node.id, NodeRunning, nil, nil)
+	if result, ok := run.restored[node.id]; ok {
+		run.logf(node.id, "Restoring node `%s`", node.id)
+		run.results <- result
+		return
+	}
+	go worker(ctx, run.newTask(node), run.results)
+}
+
+// release passes on a finished node to its successors. A successor joining
+// all of its predecessors runs once they have all finished and at least one
+// of its inbound edges is followed. A successor with a quorum runs as soon
+// as that many inbound edges are followed. Otherwise it is skipped.
+func (run *flowRun) release(node *compiledNode, follows map[string]bool) {
+	for _, id := range node.successors {
+		if !run.skipped[node.id] && !run.failed[node.id] && follows[id] {
+			run.followed[id]++
+		}
+		run.inDegree[id]--
+		if run.decided[id] {
+			continue
+		}
+		successor := run.flow.nodes[id]
+		switch {
+		case successor.quorum > 0 && run.followed[id] >= successor.quorum:
+			run.dispatch(successor)
+			run.cancelUnneeded(successor)
+		case run.inDegree[id] != 0:
+		case run.followed[id] == 0 || successor.quorum > 0:
+			run.skip(successor)
+		default:
+			run.dispatch(successor)
+		}
+	}
+}
+
+// evaluate decides which edges to its successors a finished node follows,
+// a panic of an edge condition fails the node
+func (run *flowRun) evaluate(node *compiledNode, output *simplejson.Json, route string) (follows map[string]bool, err error) {
+	defer func() {
+		if value := recover(); value != nil {
+			panicErr := recovered(value)
+			run.logf(node.id, "Condition of node `%s` panicked, %v\n%s", node.id, value, panicErr.Stack)
+			follows, err = nil, asNodeError(node.id, panicErr)
+		}
+	}()
+	follows = make(map[string]bool, len(node.successors))
+	for _, id := range node.successors {
+		follows[id] = node.follows(id, output, route)
+	}
+	return follows, nil
+}
+
+func (run *flowRun) skip(node *compiledNode) {
+	run.logf(node.id, "Skipping node `%s`", node.id)
+	run.decided[node.id] = true
+	run.skipped[node.id] = true
+	run.tracker.node(node.id, NodeSkipped, nil, nil)
+	run.release(node, nil)
+}
+
+// cancelUnneeded cancels the predecessors still running after node reached
+// its quorum, as long as no other node waits for them
+func (run *flowRun) cancelUnneeded(node *compiledNode) {
+	for _, id := range node.predecessors {
+		cancel, running := run.cancels[id]
+		if !running || run.flow.nodes[id].result {
+			continue
+		}
+		needed := false
+		for _, successor := range run.flow.nodes[id].successors {
+			if !run.decided[successor] {
+				needed = true
+			}
+		}
+		if !needed {
+			run.logf(id, "Cancelling node `%s`, `%s` reached its quorum", id, node.id)
+			run.cancelled[id] = true
+			cancel()
+		}
+	}
+}
+
+// racing reports whether node only feeds joins with a quorum that the
+// other inbound edges can still reach, its failure then counts as an edge
+// that is not followed instead of failing the run
+func (run *flowRun) racing(node *compiledNode) bool {
+	if len(node.successors) == 0 {
+		return false
+	}
+	for _, id := range node.successors {
+		successor := run.flow.nodes[id]
+		if successor.quorum == 0 {
+			return false
+		}
+		if !run.decided[id] && run.followed[id]+run.inDegree[id]-1 < successor.quorum {
+			return false
+		}
+	}
+	return true
+}
+
+// racerErrors lists the failures of racers feeding a join that was skipped
+// because it missed its quorum
+func (run *flowRun) racerErrors() []*NodeError {
+	errs := make([]*NodeError, 0)
+	for _, id := range run.flow.order {
+		nodeErr, ok := run.raced[id]
+		if !ok {
+			continue
+		}
+		for _, successor := range run.flow.nodes[id].successors {
+			if run.skipped[successor] {
+				errs = append(errs, nodeErr)
+				break
+			}
+		}
+	}
+	return errs
+}
+
+// tolerate records the failure of a node that continues on error, the node
+// then provides its fallback outputs or counts as failed for its successors
+func (run *flowRun) tolerate(result *nodeResult) {
+	node := result.node
+	run.failures = append(run.failures, asNodeError(node.id, result.err))
+	if node.fallbackOutput != nil {
+		run.logf(node.id, "Node `%s` failed, using its fallback", node.id)
+		result.output = node.fallbackOutput
+		run.store.put(node.id, node.fallbackOutput)
+		return
+	}
+	run.logf(node.id, "Node `%s` failed, continuing", node.id)
+	run.failed[node.id] = true
+}
+
+// nodeErrors lists the tolerated failures in the order the nodes were added
+func (run *flowRun) nodeErrors() []*NodeError {
+	errs := make([]*NodeError, 0, len(run.failures))
+	for _, id := range run.flow.order {
+		for _, nodeErr := range run.failures {
+			if nodeErr.NodeId == id {
+				errs = append(errs, nodeErr)
+			}
+		}
+	}
+	return errs
+}
+
+// abort cancels every node still running when a fail-fast run fails
+func (run *flowRun) abort(failed *compiledNode) {
+	for id, cancel := range run.cancels {
+		run.logf(id, "Cancelling node `%s`, `%s` failed", id, failed.id)
+		run.aborted[id] = true
+		cancel()
+	}
+}
+
+// nodesIn lists the nodes of a set in the order they were added
+func (run *flowRun) nodesIn(set map[string]bool) []string {
+	nodes := make([]string, 0, len(set))
+	for _, id := range run.flow.order {
+		if set[id] {
+			nodes = append(nodes, id)
+		}
+	}
+	return nodes
+}
+
+// result builds the run result from the declared workflow outputs, or from
+// the outputs of the last stage when none are declared. An output is left
+// out when its producers failed without failing the run or were skipped.
+func (run *flowRun) result() (*simplejson.Json, error) {
+	if len(run.flow.outputs) == 0 {
+		finals := make([]*simplejson.Json, 0, len(run.flow.finals))
+		for _, id := range run.flow.finals {
+			output, _ := run.store.node(id)
+			finals = append(finals, output)
+		}
+		return display(finals), nil
+	}
+
+	data := simplejson.New()
+	for _, output := range run.flow.outputs {
+		produced, excused := false, false
+		for _, producer := range output.producers {
+			if value, ok := run.store.get(producer, output.key); ok {
+				data.Set(output.field, value)
+				produced = true
+				break
+			}
+			if run.failed[producer] || run.skipped[producer] {
+				excused = true
+			}
+		}
+		if !produced && !excused {
+			return nil, fmt.Errorf("workflow output %q was never produced", output.source)
+		}
+	}
+	return data, nil
+}
+
+func (run *flowRun) newTask(node *compiledNode) *task {
+	return &task{
+		node:         node,
+		request:      run.request,
+		options:      run.options,
+		store:        run.store,
+		runID:        run.runID,
+		listeners:    run.listeners,
+		interceptors: run.interceptors,
+	}
+}
@@ -0,0 +1,79 @@
+package flow
+
+import (
+	"sync"
+
+	"github.com/dafanshu/simplejson"
+)
+
+// runStore keeps the outputs of every finished node of a run, keyed by the
+// producing node id and by output name
+type runStore struct {
+	flow    *CompiledFlow
+	request *simplejson.Json
+
+	mu      sync.RWMutex
+	outputs map[string]*simplejson.Json
+}
+
+func newRunStore(compiled *CompiledFlow, request []byte) *runStore {
+	global, err := simplejson.NewJson(request)
+	if err != nil {
+		global = simplejson.New()
+	}
+	return &runStore{
+		flow:    compiled,
+		request: global,
+		outputs: make(map[string]*simplejson.Json, len(compiled.nodes)),
+	}
+}
+
+func (store *runStore) put(nodeId string, output *simplejson.Json) {
+	if output == nil {
+		output = simplejson.New()
+	}
+	store.mu.Lock()
+	store.outputs[nodeId] = output
+	store.mu.Unlock()
+}
+
+// node returns the outputs produced by a finished node
+func (store *runStore) node(nodeId string) (*simplejson.Json, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	output, ok := store.outputs[nodeId]
+	return output, ok
+}
+
+// get returns the value of a single output of a finished node
+func (store *runStore) get(nodeId, key string) (*simplejson.Json, bool) {
+	output, ok := store.node(nodeId)
+	if !ok {
+		return nil, false
+	}
+	return output.CheckGet(key)
+}
+
+// resolve resolves an In key of node. A "nodeId.key" reference reads the
+// output of that ancestor, otherwise the nearest ancestor that produced the
+// key wins and the global request is the fallback.
+func (store *runStore) resolve(node *compiledNode, key string) (*simplejson.Json, bool) {
+	if producer, name, ok := store.flow.splitRef(key); ok && node.hasAncestor(producer) {
+		return store.get(producer, name)
+	}
+	for _, ancestor := range node.ancestors {
+		if value, ok := store.get(ancestor, key); ok {
+			return value, true
+		}
+	}
+	return store.request.CheckGet(key)
+}
+
+func (node *compiledNode) hasAncestor(id string) bool {
+	for _, ancestor := range node.ancestors {
+		if ancestor == id {
+			return true
+		}
+	}
+	return false
+}
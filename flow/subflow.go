@@ -0,0 +1,73 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dafanshu/simplejson"
+)
+
+// subFlowOperation runs a whole workflow as an operation of a node
+type subFlowOperation struct {
+	flow     *Workflow
+	compiled *CompiledFlow
+}
+
+// SubFlow embeds another workflow as an operation of the node. The child
+// gets the node's input (its In keys) as request and its result is mapped
+// to the node's Out keys. The child runs within the parent's context,
+// deadline, request-id and failure mode. Child nodes that fail without
+// failing the child fail the node with a PartialError.
+func (node *Node) SubFlow(child *Workflow) *Node {
+	node.unode.AddOperation(&subFlowOperation{flow: child})
+	return node
+}
+
+func (operation *subFlowOperation) GetId() string {
+	return "subflow"
+}
+
+func (operation *subFlowOperation) Encode() []byte {
+	return []byte("")
+}
+
+func (operation *subFlowOperation) GetProperties() map[string][]string {
+	result := make(map[string][]string)
+	result["isSubFlow"] = []string{"true"}
+	return result
+}
+
+func (operation *subFlowOperation) Execute(ctx context.Context, data []byte, option map[string]interface{}) ([]byte, error) {
+	if operation.compiled == nil {
+		return nil, fmt.Errorf("subflow is not compiled")
+	}
+	request, err := simplejson.NewJson(data)
+	if err != nil {
+		request = simplejson.New()
+	}
+	if _, ok := request.CheckGet("request-id"); !ok {
+		request.Set("request-id", fmt.Sprintf("%v", option["request-id"]))
+	}
+	childRequest, err := request.MarshalJSON()
+	if err != nil {
+		return nil, err
+	}
+
+	child := newFlowRun(operation.compiled, childRequest, option)
+	if parent, ok := ctx.Value(runKey{}).(*flowRun); ok {
+		child.runID = parent.runID
+		child.listeners = parent.listeners
+		child.interceptors = parent.interceptors
+		child.compensationTimeout = parent.compensationTimeout
+		child.failFast = parent.failFast
+		parent.logf("", "Executing subflow")
+	}
+	result, err := child.execute(ctx)
+	if err == nil && len(result.Errors) > 0 {
+		err = &PartialError{Errors: result.Errors}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error: subflow failed, %w", err)
+	}
+	return result.Output, nil
+}
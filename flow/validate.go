@@ -0,0 +1,369 @@
+package flow
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dafanshu/mini-flow/sdk"
+	"github.com/dafanshu/simplejson"
+)
+
+// DiagnosticKind classifies a problem found by Validate
+type DiagnosticKind string
+
+const (
+	DiagCycle             DiagnosticKind = "cycle"
+	DiagUndeclaredNode    DiagnosticKind = "undeclared-node"
+	DiagNoOperations      DiagnosticKind = "no-operations"
+	DiagUnsatisfiedInput  DiagnosticKind = "unsatisfied-input"
+	DiagDuplicateOutput   DiagnosticKind = "duplicate-output"
+	DiagUnreachable       DiagnosticKind = "unreachable"
+	DiagDeadEnd           DiagnosticKind = "dead-end"
+	DiagInvalidDefinition DiagnosticKind = "invalid-definition"
+)
+
+// Diagnostic is a problem of a workflow definition
+type Diagnostic struct {
+	Kind DiagnosticKind
+	// NodeId is the node the problem is about, if any
+	NodeId  string
+	Message string
+}
+
+func (diag *Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s", diag.Kind, diag.Message)
+}
+
+// ValidationError lists every problem found by Validate
+type ValidationError struct {
+	Diagnostics []*Diagnostic
+}
+
+func (err *ValidationError) Error() string {
+	messages := make([]string, 0, len(err.Diagnostics))
+	for _, diag := range err.Diagnostics {
+		messages = append(messages, diag.String())
+	}
+	return fmt.Sprintf("workflow has %d problem(s): %s", len(messages), strings.Join(messages, "; "))
+}
+
+// Inputs declares the keys of the global request, an In key read from the
+// request has to be declared for Validate to accept it
+func (flow *Workflow) Inputs(keys ...string) *Workflow {
+	flow.inputs = append(flow.inputs, keys...)
+	return flow
+}
+
+// Validate checks the workflow definition and reports all the problems it
+// finds at once as a *ValidationError
+func (flow *Workflow) Validate() error {
+	if flow.uflow == nil {
+		return &ValidationError{Diagnostics: []*Diagnostic{{
+			Kind: DiagInvalidDefinition, Message: "workflow has no DAG",
+		}}}
+	}
+	v := newValidator(flow)
+	v.checkNodes()
+	cycle := flow.uflow.udag.FindCycle()
+	if cycle != nil {
+		v.report(DiagCycle, cycle[0], "cycle %s", strings.Join(cycle, " -> "))
+	}
+	v.checkInputs()
+	v.checkOutputs()
+	v.checkReachability()
+	// the run result is only known for a workflow that compiles
+	if cycle == nil {
+		if compiled, err := flow.Compile(); err != nil {
+			v.report(DiagInvalidDefinition, "", "%v", err)
+		} else {
+			v.checkDeadEnds(compiled)
+		}
+	}
+	if len(v.diagnostics) == 0 {
+		return nil
+	}
+	return &ValidationError{Diagnostics: v.diagnostics}
+}
+
+// validator checks the DAG as declared, so that the checks also run on a
+// workflow that does not compile
+type validator struct {
+	flow  *Workflow
+	udag  *sdk.Dag
+	order []string
+	// predecessors and ancestors of every node, ancestors also hold the
+	// nodes of a cycle through the node
+	predecessors map[string][]string
+	ancestors    map[string]map[string]bool
+	diagnostics  []*Diagnostic
+}
+
+func newValidator(flow *Workflow) *validator {
+	v := &validator{
+		flow:         flow,
+		udag:         flow.uflow.udag,
+		predecessors: make(map[string][]string),
+		ancestors:    make(map[string]map[string]bool),
+	}
+	for _, node := range v.udag.Nodes() {
+		v.order = append(v.order, node.Id)
+		for _, successor := range v.udag.Successors(node.Id) {
+			v.predecessors[successor] = append(v.predecessors[successor], node.Id)
+		}
+	}
+	for _, id := range v.order {
+		v.ancestors[id] = ancestorsOf(v.udag, id)
+	}
+	return v
+}
+
+func (v *validator) report(kind DiagnosticKind, nodeId, format string, args ...interface{}) {
+	v.diagnostics = append(v.diagnostics, &Diagnostic{Kind: kind, NodeId: nodeId, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) offer(id string) ([]string, []string) {
+	return v.udag.GetV(id).Offer()
+}
+
+func (v *validator) provides(id, key string) bool {
+	_, outputs := v.offer(id)
+	return contains(outputs, key)
+}
+
+// checkNodes reports the nodes only created by an edge and the nodes
+// without operations, a choice node may route its input as is
+func (v *validator) checkNodes() {
+	for _, id := range v.order {
+		node := v.udag.GetV(id)
+		if node.Implicit() {
+			edges := make([]string, 0)
+			for _, predecessor := range v.predecessors[id] {
+				edges = append(edges, predecessor+" -> "+id)
+			}
+			for _, successor := range v.udag.Successors(id) {
+				edges = append(edges, id+" -> "+successor)
+			}
+			v.report(DiagUndeclaredNode, id, "edge %s refers to undeclared node %s",
+				strings.Join(edges, ", "), id)
+			continue
+		}
+		if spec, ok := v.flow.uflow.specs[id]; ok && spec.choice != nil {
+			continue
+		}
+		if len(node.Operations()) == 0 {
+			v.report(DiagNoOperations, id, "node %s has no operations", id)
+		}
+	}
+}
+
+// checkInputs reports the In keys no upstream node outputs and that are not
+// declared as inputs of the workflow
+func (v *validator) checkInputs() {
+	declared := make(map[string]bool, len(v.flow.inputs))
+	for _, key := range v.flow.inputs {
+		declared[key] = true
+	}
+	for _, id := range v.order {
+		inputs, _ := v.offer(id)
+		for _, key := range inputs {
+			if dot := strings.Index(key, "."); dot > 0 && dot < len(key)-1 && v.udag.GetV(key[:dot]) != nil {
+				producer, name := key[:dot], key[dot+1:]
+				switch {
+				case !v.ancestors[id][producer]:
+					v.report(DiagUnsatisfiedInput, id, "node %s reads %s but %s is not upstream of it", id, key, producer)
+				case !v.provides(producer, name):
+					v.report(DiagUnsatisfiedInput, id, "node %s reads %s but %s does not output %q", id, key, producer, name)
+				}
+				continue
+			}
+			provided := declared[key]
+			for ancestor := range v.ancestors[id] {
+				if v.provides(ancestor, key) {
+					provided = true
+				}
+			}
+			if !provided {
+				v.report(DiagUnsatisfiedInput, id,
+					"node %s reads %q which no upstream node outputs and is not a workflow input", id, key)
+			}
+		}
+	}
+}
+
+// checkOutputs reports output keys produced by nodes that may run in
+// parallel, the node reading the key or the run result then depends on
+// which one finishes last
+func (v *validator) checkOutputs() {
+	for i, a := range v.order {
+		for _, b := range v.order[i+1:] {
+			if v.ancestors[a][b] || v.ancestors[b][a] || v.exclusive(a, b) {
+				continue
+			}
+			_, outputs := v.offer(a)
+			for _, key := range outputs {
+				if v.provides(b, key) {
+					v.report(DiagDuplicateOutput, b, "nodes %s and %s both output %q and may run in parallel", a, b, key)
+				}
+			}
+		}
+	}
+}
+
+// exclusive reports whether a and b run in different branches of one
+// choice node, and so never run together
+func (v *validator) exclusive(a, b string) bool {
+	for _, id := range v.order {
+		spec, ok := v.flow.uflow.specs[id]
+		if !ok || spec.choice == nil {
+			continue
+		}
+		branchA, branchB := v.branch(spec.choice, a), v.branch(spec.choice, b)
+		if branchA != "" && branchB != "" && branchA != branchB {
+			return true
+		}
+	}
+	return false
+}
+
+// branch returns the Case or Default target of the choice that node id only
+// runs after, or "" when it may run whatever branch is taken. A join with a
+// quorum below the branch may also run from outside of it.
+func (v *validator) branch(choice *choice, id string) string {
+	targets := make([]string, 0, len(choice.cases)+1)
+	for _, target := range choice.cases {
+		targets = append(targets, target)
+	}
+	if choice.defaultNode != "" {
+		targets = append(targets, choice.defaultNode)
+	}
+	branch := ""
+	for _, target := range targets {
+		if target != id && !v.ancestors[id][target] {
+			continue
+		}
+		if branch != "" && branch != target {
+			return ""
+		}
+		branch = target
+	}
+	if branch == "" {
+		return ""
+	}
+	for _, node := range v.order {
+		if node == branch || (node != id && !v.ancestors[id][node]) || !v.ancestors[node][branch] {
+			continue
+		}
+		if spec, ok := v.flow.uflow.specs[node]; ok && spec.join.quorum > 0 {
+			return ""
+		}
+	}
+	return branch
+}
+
+// checkReachability reports edge conditions reading keys their node never
+// outputs and the nodes that can never run. An edge is never followed when
+// its condition only reads such keys and is false without them, a node is
+// never run when too few of its inbound edges can be followed.
+func (v *validator) checkReachability() {
+	index := make(map[string]int, len(v.order))
+	for i, id := range v.order {
+		index[id] = i
+	}
+	edges := make([]edge, 0, len(v.flow.uflow.conditions))
+	for edge := range v.flow.uflow.conditions {
+		edges = append(edges, edge)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].from != edges[j].from {
+			return index[edges[i].from] < index[edges[j].from]
+		}
+		return index[edges[i].to] < index[edges[j].to]
+	})
+
+	never := make(map[edge]bool)
+	for _, edge := range edges {
+		condition := v.flow.uflow.conditions[edge]
+		if condition.expr == "" {
+			continue
+		}
+		keys := conditionKeys(condition.expr)
+		missing := 0
+		for _, key := range keys {
+			if !v.provides(edge.from, key) {
+				missing++
+				v.report(DiagUnsatisfiedInput, edge.from, "condition of edge %s -> %s reads %q which %s does not output",
+					edge.from, edge.to, key, edge.from)
+			}
+		}
+		cond, err := ParseCondition(condition.expr)
+		if err == nil && missing == len(keys) && !cond(simplejson.New()) {
+			never[edge] = true
+		}
+	}
+
+	unreachable := make(map[string]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, id := range v.order {
+			predecessors := v.predecessors[id]
+			if unreachable[id] || len(predecessors) == 0 {
+				continue
+			}
+			possible := 0
+			for _, predecessor := range predecessors {
+				if !unreachable[predecessor] && !never[edge{from: predecessor, to: id}] {
+					possible++
+				}
+			}
+			quorum := 1
+			if spec, ok := v.flow.uflow.specs[id]; ok && spec.join.quorum > 0 {
+				quorum = spec.join.quorum
+			}
+			if possible < quorum {
+				unreachable[id] = true
+				changed = true
+			}
+		}
+	}
+	for _, id := range v.order {
+		if unreachable[id] {
+			v.report(DiagUnreachable, id, "node %s can never run, too few of its inbound edges can be followed", id)
+		}
+	}
+}
+
+// checkDeadEnds reports the final nodes whose outputs never reach the result
+func (v *validator) checkDeadEnds(compiled *CompiledFlow) {
+	for _, id := range compiled.order {
+		node := compiled.nodes[id]
+		if len(node.successors) == 0 && len(node.outputs) > 0 && !node.result {
+			v.report(DiagDeadEnd, id, "outputs of node %s are never read and never reach the result", id)
+		}
+	}
+}
+
+// conditionKeys lists the output keys a condition expression reads
+func conditionKeys(expr string) []string {
+	keys := make([]string, 0)
+	for _, token := range tokenize(expr) {
+		if token.kind != tokenIdent {
+			continue
+		}
+		switch token.text {
+		case "true", "false", "null":
+			continue
+		}
+		keys = append(keys, strings.SplitN(token.text, ".", 2)[0])
+	}
+	return keys
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
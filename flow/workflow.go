@@ -3,20 +3,72 @@ package flow
 import (
 	"container/list"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/dafanshu/mini-flow/sdk"
+	"github.com/dafanshu/simplejson"
 )
 
 type Workflow struct {
-	uflow *Dag
+	uflow   *Dag
+	outputs []output
+	// inputs are the keys the global request is expected to carry
+	inputs []string
+}
+
+// output maps a field of the workflow result to a node output, source is
+// either an output key or a "nodeId.key" reference
+type output struct {
+	field  string
+	source string
 }
 
 type Dag struct {
-	udag *sdk.Dag
+	udag       *sdk.Dag
+	specs      map[string]*nodeSpec
+	conditions map[edge]edgeCondition
+}
+
+type edge struct {
+	from string
+	to   string
+}
+
+// edgeCondition guards an edge with a Go predicate or an expression
+type edgeCondition struct {
+	cond Condition
+	expr string
 }
 
 type Node struct {
 	unode *sdk.Node
+	spec  *nodeSpec
+	dag   *Dag
+}
+
+// nodeSpec holds the execution settings of a node that the sdk graph does
+// not model
+type nodeSpec struct {
+	timeout time.Duration
+	choice  *choice
+	forEach *forEach
+	loop    *loop
+	join    Join
+	// continueOnError keeps the run going when the node fails, fallback
+	// then replaces the outputs of the node
+	continueOnError bool
+	fallback        []byte
+	compensations   []sdk.Operation
+	interceptors    []Interceptor
+}
+
+// choice routes a choice node to exactly one of its branches
+type choice struct {
+	selector Selector
+	// cases maps a branch name to the node it activates
+	cases       map[string]string
+	defaultNode string
 }
 
 // Options options for operation execution
@@ -27,6 +79,8 @@ type Options struct {
 	failureHandler  FuncErrorHandler
 	requestHandler  ReqHandler
 	responseHandler RespHandler
+	timeout         time.Duration
+	retry           *RetryPolicy
 }
 
 type Option func(*Options)
@@ -47,13 +101,38 @@ func Query(key string, value ...string) Option {
 	}
 }
 
+// Timeout bounds a single execution of the operation
+func Timeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.timeout = timeout
+	}
+}
+
 func (flow *Workflow) NewDag() *Dag {
 	dag := &Dag{}
 	dag.udag = sdk.NewDag()
+	dag.specs = make(map[string]*nodeSpec)
+	dag.conditions = make(map[edge]edgeCondition)
 	flow.uflow = dag
 	return dag
 }
 
+// Outputs declares the fields of the workflow result. Each source is an
+// output key or a "nodeId.key" reference, the result field is the key.
+// Without declared outputs the result merges the outputs of the last stage.
+func (flow *Workflow) Outputs(sources ...string) *Workflow {
+	for _, source := range sources {
+		flow.outputs = append(flow.outputs, output{source: source})
+	}
+	return flow
+}
+
+// OutputAs declares a result field filled from a node output
+func (flow *Workflow) OutputAs(field, source string) *Workflow {
+	flow.outputs = append(flow.outputs, output{field: field, source: source})
+	return flow
+}
+
 func (flow *Workflow) GetStartNodes() *list.List {
 	return flow.uflow.udag.StartV()
 }
@@ -103,13 +182,37 @@ func (dag *Dag) Node(vertex string) *Node {
 	if node == nil {
 		node = dag.udag.AddV(vertex, []sdk.Operation{})
 	}
-	return &Node{unode: node}
+	node.Declare()
+	return &Node{unode: node, spec: dag.spec(vertex), dag: dag}
+}
+
+func (dag *Dag) spec(vertex string) *nodeSpec {
+	spec, ok := dag.specs[vertex]
+	if !ok {
+		spec = &nodeSpec{}
+		dag.specs[vertex] = spec
+	}
+	return spec
 }
 
 func (dag *Dag) Edge(from, to string) {
 	dag.udag.AddE(from, to)
 }
 
+// EdgeIf adds an edge that is only followed when cond holds on the outputs
+// of from. A node whose inbound edges are all not followed is skipped, and
+// so are its descendants that are left without a followed inbound edge.
+func (dag *Dag) EdgeIf(from, to string, cond Condition) {
+	dag.udag.AddE(from, to)
+	dag.conditions[edge{from: from, to: to}] = edgeCondition{cond: cond}
+}
+
+// EdgeWhen is EdgeIf with a condition expression, see ParseCondition
+func (dag *Dag) EdgeWhen(from, to, expr string) {
+	dag.udag.AddE(from, to)
+	dag.conditions[edge{from: from, to: to}] = edgeCondition{expr: expr}
+}
+
 func (dag *Dag) CheckDag() bool {
 	return sdk.CheckDag(dag.udag)
 }
@@ -120,78 +223,27 @@ func (o *Options) reset() {
 	o.failureHandler = nil
 	o.requestHandler = nil
 	o.responseHandler = nil
+	o.timeout = 0
+	o.retry = nil
 }
 
-func (node *Node) Modify(mod Modifier) *Node {
+func (node *Node) Modify(mod Modifier, opts ...Option) *Node {
 	newMod := createModifier(mod)
+	newMod.applyOptions(opts)
 	node.unode.AddOperation(newMod)
 	return node
 }
 
 func (node *Node) Apply(function string, opts ...Option) *Node {
 	newfunc := createFunction(function)
-
-	o := &Options{}
-	for _, opt := range opts {
-		o.reset()
-		opt(o)
-		if len(o.header) != 0 {
-			for key, value := range o.header {
-				newfunc.addheader(key, value)
-			}
-		}
-		if len(o.query) != 0 {
-			for key, array := range o.query {
-				for _, value := range array {
-					newfunc.addparam(key, value)
-				}
-			}
-		}
-		if o.failureHandler != nil {
-			newfunc.addFailureHandler(o.failureHandler)
-		}
-		if o.responseHandler != nil {
-			newfunc.addResponseHandler(o.responseHandler)
-		}
-		if o.requestHandler != nil {
-			newfunc.addRequestHandler(o.requestHandler)
-		}
-	}
-
+	newfunc.applyOptions(opts)
 	node.unode.AddOperation(newfunc)
 	return node
 }
 
 func (node *Node) Request(url string, opts ...Option) *Node {
 	newHttpRequest := createHttpRequest(url)
-
-	o := &Options{}
-	for _, opt := range opts {
-		o.reset()
-		opt(o)
-		if len(o.header) != 0 {
-			for key, value := range o.header {
-				newHttpRequest.addheader(key, value)
-			}
-		}
-		if len(o.query) != 0 {
-			for key, array := range o.query {
-				for _, value := range array {
-					newHttpRequest.addparam(key, value)
-				}
-			}
-		}
-		if o.failureHandler != nil {
-			newHttpRequest.addFailureHandler(o.failureHandler)
-		}
-		if o.responseHandler != nil {
-			newHttpRequest.addResponseHandler(o.responseHandler)
-		}
-		if o.requestHandler != nil {
-			newHttpRequest.addRequestHandler(o.requestHandler)
-		}
-	}
-
+	newHttpRequest.applyOptions(opts)
 	node.unode.AddOperation(newHttpRequest)
 	return node
 }
@@ -205,3 +257,68 @@ func (node *Node) Out(output ...string) *Node {
 	node.unode.AddProvides(output...)
 	return node
 }
+
+// Timeout bounds the execution of the whole operation chain of the node
+func (node *Node) Timeout(timeout time.Duration) *Node {
+	node.spec.timeout = timeout
+	return node
+}
+
+// Switch turns the node into a choice node. After the operations of the
+// node ran, selector picks the branch to activate from its result, the
+// nodes of the other branches are skipped.
+func (node *Node) Switch(selector Selector) *Node {
+	node.choice().selector = selector
+	return node
+}
+
+// SwitchOn is Switch on the value of a key of the node's result
+func (node *Node) SwitchOn(key string) *Node {
+	return node.Switch(func(data []byte) (string, error) {
+		result, err := simplejson.NewJson(data)
+		if err != nil {
+			return "", err
+		}
+		value, ok := result.CheckGet(key)
+		if !ok {
+			return "", nil
+		}
+		return fmt.Sprint(jsonValue(value)), nil
+	})
+}
+
+// Case routes the branch of a choice node to the node `to`
+func (node *Node) Case(branch string, to string) *Node {
+	node.choice().cases[branch] = to
+	node.dag.Edge(node.unode.Id, to)
+	return node
+}
+
+// Default routes a choice node to the node `to` when no case matches
+func (node *Node) Default(to string) *Node {
+	node.choice().defaultNode = to
+	node.dag.Edge(node.unode.Id, to)
+	return node
+}
+
+func (node *Node) choice() *choice {
+	if node.spec.choice == nil {
+		node.spec.choice = &choice{cases: make(map[string]string)}
+	}
+	return node.spec.choice
+}
+
+// ContinueOnError records a failure of the node instead of failing the run,
+// the descendants that are left without a followed inbound edge are skipped
+func (node *Node) ContinueOnError() *Node {
+	node.spec.continueOnError = true
+	return node
+}
+
+// Fallback is ContinueOnError with the JSON object used as the outputs of
+// the node when it fails, its descendants then run as usual
+func (node *Node) Fallback(output []byte) *Node {
+	node.spec.continueOnError = true
+	node.spec.fallback = output
+	return node
+}
@@ -85,7 +85,7 @@ func main() {
 	executor := flow.FlowExecutor{Flow: workflow}
 	result, err := executor.ExecuteFlow(request)
 	if err != nil {
-		fmt.Errorf(err.Error())
+		fmt.Println(err.Error())
 	}
 	fmt.Println(string(result))
 	var mapResult map[string]interface{}
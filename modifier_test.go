@@ -28,7 +28,7 @@ func TestModiferInitData(t *testing.T) {
 	executor := flow.FlowExecutor{Flow: workflow}
 	result, err := executor.ExecuteFlow(data)
 	if err != nil {
-		fmt.Errorf(err.Error())
+		fmt.Println(err.Error())
 	}
 	fmt.Println(result)
 	//raw := `{"foo":"bar"}`
@@ -3,6 +3,7 @@ package sdk
 import (
 	"container/list"
 	"fmt"
+	"sort"
 )
 
 var (
@@ -31,6 +32,8 @@ type Node struct {
 	provides   []string
 	rebinds    []string
 	operations []Operation
+	// implicit 标记由AddE自动创建、尚未声明的顶点
+	implicit bool
 }
 
 // 创建图
@@ -81,20 +84,22 @@ func (dag *Dag) AddV(id string, options ...[]Operation) *Node {
 
 // 新增图的一条边E
 func (dag *Dag) AddE(from string, to string) error {
+	fromNode := dag.nodes[from]
+	if fromNode == nil {
+		fromNode = dag.AddV(from)
+		fromNode.implicit = true
+	}
 	adjList := dag.edges[from]
 	for item := adjList.Front(); nil != item; item = item.Next() {
 		if item.Value == to {
 			return ERR_DUPLICATE_EDGE
 		}
 	}
-	fromNode := dag.nodes[from]
-	if fromNode == nil {
-		fromNode = dag.AddV(from)
-	}
 	fromNode.degree(OUTDEGREE, INCREMENT)
 	toNode := dag.nodes[to]
 	if toNode == nil {
 		toNode = dag.AddV(to)
+		toNode.implicit = true
 	}
 	toNode.degree(INDEGREE, INCREMENT)
 	adjList.PushBack(to)
@@ -126,6 +131,72 @@ func (dag *Dag) StartV() *list.List {
 	return startNodes
 }
 
+// 按添加顺序返回图中所有顶点
+func (dag *Dag) Nodes() []*Node {
+	nodes := make([]*Node, 0, len(dag.nodes))
+	for _, node := range dag.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].index < nodes[j].index
+	})
+	return nodes
+}
+
+// 返回顶点的所有直接后继顶点Id
+func (dag *Dag) Successors(id string) []string {
+	successors := make([]string, 0)
+	adjList := dag.edges[id]
+	if adjList == nil {
+		return successors
+	}
+	for item := adjList.Front(); nil != item; item = item.Next() {
+		successors = append(successors, item.Value.(string))
+	}
+	return successors
+}
+
+// 返回图中的一个回路，首尾为同一顶点，无回路时返回nil
+func (dag *Dag) FindCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(dag.nodes))
+	path := make([]string, 0)
+	var visit func(id string) []string
+	visit = func(id string) []string {
+		state[id] = visiting
+		path = append(path, id)
+		for _, next := range dag.Successors(id) {
+			switch state[next] {
+			case visiting:
+				for i, v := range path {
+					if v == next {
+						return append(append([]string{}, path[i:]...), next)
+					}
+				}
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = visited
+		return nil
+	}
+	for _, node := range dag.Nodes() {
+		if state[node.Id] == unvisited {
+			if cycle := visit(node.Id); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
 func (dag *Dag) NodeIndex() int {
 	return dag.nodeIndex
 }
@@ -161,6 +232,24 @@ func (node *Node) degree(inOut int, step int) {
 	}
 }
 
+func (node *Node) InDegree() int {
+	return node.inDegree
+}
+
+func (node *Node) OutDegree() int {
+	return node.outDegree
+}
+
+// 顶点是否由AddE自动创建且未被声明
+func (node *Node) Implicit() bool {
+	return node.implicit
+}
+
+// 声明顶点，清除其自动创建标记
+func (node *Node) Declare() {
+	node.implicit = false
+}
+
 func (node *Node) AddOperation(operation Operation) {
 	node.operations = append(node.operations, operation)
 }
@@ -0,0 +1,658 @@
+package workflow_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dafanshu/mini-flow/flow"
+	"github.com/dafanshu/simplejson"
+	"github.com/stretchr/testify/assert"
+)
+
+func buildSumFlow() *flow.Workflow {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+
+	dag.Node("node1").Modify(func(data []byte) ([]byte, error) {
+		result, _ := simplejson.NewJson(data)
+		in, _ := result.Get("in_foo").Int()
+		result.Set("out_node1", in+1)
+		return result.MarshalJSON()
+	}).In("in_foo").Out("out_node1")
+
+	dag.Node("node2").Modify(func(data []byte) ([]byte, error) {
+		result, _ := simplejson.NewJson(data)
+		in, _ := result.Get("in_foo").Int()
+		result.Set("out_node2", in*2)
+		return result.MarshalJSON()
+	}).In("in_foo").Out("out_node2")
+
+	dag.Node("node3").Modify(func(data []byte) ([]byte, error) {
+		result, _ := simplejson.NewJson(data)
+		a, _ := result.Get("out_node1").Int()
+		b, _ := result.Get("out_node2").Int()
+		result.Set("sum", a+b)
+		return result.MarshalJSON()
+	}).In("out_node1", "out_node2").Out("sum")
+
+	dag.Edge("node1", "node3")
+	dag.Edge("node2", "node3")
+	return workflow
+}
+
+func TestReuseWorkflow(t *testing.T) {
+	executor := flow.FlowExecutor{Flow: buildSumFlow(), Ctx: context.TODO()}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			request := []byte(fmt.Sprintf(`{"in_foo":%d}`, i))
+			result, err := executor.ExecuteFlow(request)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, fmt.Sprintf(`{"sum":%d}`, i+1+i*2), string(result))
+		}(i)
+	}
+	wg.Wait()
+
+	// runs see the changes made to the workflow, unless they execute a
+	// compiled snapshot of it
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("a").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"x":1}`), nil
+	}).Out("x")
+	compiled, err := workflow.Compile()
+	assert.Equal(t, nil, err)
+	executor = flow.FlowExecutor{Flow: workflow}
+	snapshot := flow.FlowExecutor{Compiled: compiled}
+	result, err := executor.ExecuteFlow([]byte(`{}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"x":1}`, string(result))
+
+	dag.Node("b").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"x":2}`), nil
+	}).In("x").Out("x").Join(flow.JoinQuorum(2))
+	dag.Edge("a", "b")
+	_, err = executor.ExecuteFlow([]byte(`{}`))
+	assert.EqualError(t, err, "node b: quorum 2 exceeds its 1 predecessors")
+
+	dag.Node("c").Modify(echo)
+	dag.Edge("c", "b")
+	result, err = executor.ExecuteFlow([]byte(`{}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"x":2}`, string(result))
+	result, err = snapshot.ExecuteFlow([]byte(`{}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"x":1}`, string(result))
+}
+
+func TestReadyQueue(t *testing.T) {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+
+	finished := make(chan string, 3)
+	dag.Node("slow").Modify(func(data []byte) ([]byte, error) {
+		time.Sleep(200 * time.Millisecond)
+		finished <- "slow"
+		return []byte(`{"slow":true}`), nil
+	}).Out("slow")
+
+	dag.Node("fast").Modify(func(data []byte) ([]byte, error) {
+		finished <- "fast"
+		return []byte(`{"fast":true}`), nil
+	}).Out("fast")
+
+	dag.Node("next").Modify(func(data []byte) ([]byte, error) {
+		finished <- "next"
+		return data, nil
+	}).In("fast").Out("fast")
+
+	dag.Edge("fast", "next")
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	_, err := executor.ExecuteFlow([]byte(`{}`))
+	assert.Equal(t, nil, err)
+
+	close(finished)
+	order := make([]string, 0)
+	for id := range finished {
+		order = append(order, id)
+	}
+	assert.Equal(t, []string{"fast", "next", "slow"}, order)
+}
+
+func TestAncestorOutputs(t *testing.T) {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+
+	dag.Node("node1").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"token":"abc","shared":"node1"}`), nil
+	}).Out("token", "shared")
+
+	dag.Node("node2").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"user":"bob","shared":"node2"}`), nil
+	}).In("token").Out("user", "shared")
+
+	dag.Node("node3").Modify(func(data []byte) ([]byte, error) {
+		return data, nil
+	}).In("token", "user", "shared", "node1.shared").Out("token", "user", "shared", "node1.shared")
+
+	dag.Edge("node1", "node2")
+	dag.Edge("node2", "node3")
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	result, err := executor.ExecuteFlow([]byte(`{"user":"global"}`))
+	assert.Equal(t, nil, err)
+
+	target := `{"node1.shared":"node1","shared":"node2","token":"abc","user":"bob"}`
+	assert.Equal(t, target, string(result))
+}
+
+func TestWorkflowOutputs(t *testing.T) {
+	workflow := buildSumFlow()
+	workflow.Outputs("out_node1", "node2.out_node2").OutputAs("total", "sum")
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	result, err := executor.ExecuteFlow([]byte(`{"in_foo":3}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"out_node1":4,"out_node2":6,"total":10}`, string(result))
+
+	missing := new(flow.Workflow)
+	missing.NewDag().Node("node1").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{}`), nil
+	}).Out("never")
+	missing.Outputs("never")
+
+	executor = flow.FlowExecutor{Flow: missing}
+	_, err = executor.ExecuteFlow([]byte(`{}`))
+	assert.EqualError(t, err, `workflow output "never" was never produced`)
+}
+
+func TestTimeouts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"late":true}`))
+	}))
+	defer server.Close()
+
+	workflow := new(flow.Workflow)
+	workflow.NewDag().Node("slow-request").Request(server.URL, flow.Timeout(20*time.Millisecond)).Out("late")
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	_, err := executor.ExecuteFlow([]byte(`{}`))
+
+	assert.Contains(t, err.Error(), "node `slow-request` operation `http-req-/127.0.0.1")
+	assert.Contains(t, err.Error(), "operation timeout of 20ms exceeded")
+
+	workflow = new(flow.Workflow)
+	workflow.NewDag().Node("slow-modifier").Modify(func(data []byte) ([]byte, error) {
+		time.Sleep(200 * time.Millisecond)
+		return data, nil
+	}).Timeout(20 * time.Millisecond)
+
+	executor = flow.FlowExecutor{Flow: workflow}
+	_, err = executor.ExecuteFlow([]byte(`{}`))
+	assert.EqualError(t, err, "[node `slow-modifier` operation `modifier`: node timeout of 20ms exceeded,]")
+}
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch {
+		case r.URL.Path == "/bad":
+			w.WriteHeader(http.StatusBadRequest)
+		case calls < 3:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			w.Write([]byte(`{"ok":true}`))
+		}
+	}))
+	defer server.Close()
+
+	retry := flow.Retry(3, flow.Backoff(time.Millisecond, 10*time.Millisecond, 2))
+
+	workflow := new(flow.Workflow)
+	workflow.NewDag().Node("flaky").Request(server.URL+"/flaky", retry).Out("ok")
+	executor := flow.FlowExecutor{Flow: workflow}
+	result, err := executor.ExecuteFlow([]byte(`{}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"ok":true}`, string(result))
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	workflow = new(flow.Workflow)
+	workflow.NewDag().Node("bad").Request(server.URL+"/bad", retry).Out("ok")
+	executor = flow.FlowExecutor{Flow: workflow}
+	_, err = executor.ExecuteFlow([]byte(`{}`))
+	assert.Contains(t, err.Error(), "invalid return status 400")
+	assert.Equal(t, 1, calls)
+}
+
+func TestStart(t *testing.T) {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	release := make(chan struct{})
+	dag.Node("first").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"done":true}`), nil
+	}).Out("done")
+	dag.Node("second").Modify(func(data []byte) ([]byte, error) {
+		<-release
+		return data, nil
+	}).In("done").Out("done")
+	dag.Node("never").Modify(func(data []byte) ([]byte, error) {
+		return data, nil
+	})
+	dag.EdgeIf("first", "never", func(*simplejson.Json) bool { return false })
+	dag.Edge("first", "second")
+
+	executor := flow.FlowExecutor{Flow: workflow}
+	runID, err := executor.Start([]byte(`{}`))
+	assert.Equal(t, nil, err)
+
+	_, err = executor.Result(runID)
+	assert.Equal(t, flow.ErrRunNotFinished, err)
+	var status *flow.RunStatus
+	for i := 0; i < 100; i++ {
+		status, _ = executor.Status(runID)
+		if status.Nodes[1].State == flow.NodeRunning {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, flow.RunRunning, status.State)
+	assert.Equal(t, flow.NodeSucceeded, status.Nodes[0].State)
+	assert.Equal(t, flow.NodeRunning, status.Nodes[1].State)
+	assert.Equal(t, flow.NodeSkipped, status.Nodes[2].State)
+
+	close(release)
+	result, err := executor.Wait(runID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"done":true}`, string(result.Output))
+	status, _ = executor.Status(runID)
+	assert.Equal(t, flow.RunSucceeded, status.State)
+	assert.Equal(t, flow.NodeSucceeded, status.Nodes[1].State)
+
+	assert.Equal(t, nil, executor.Forget(runID))
+	_, err = executor.Status(runID)
+	assert.Equal(t, flow.ErrUnknownRun, err)
+}
+
+func TestStream(t *testing.T) {
+	executor := flow.FlowExecutor{Flow: buildSumFlow()}
+	runID, events, err := executor.Stream([]byte(`{"in_foo":3}`))
+	assert.Equal(t, nil, err)
+
+	states := make(map[string][]flow.NodeState)
+	outputs := make(map[string]string)
+	for event := range events {
+		assert.Equal(t, runID, event.RunId)
+		states[event.NodeId] = append(states[event.NodeId], event.State)
+		if event.State == flow.NodeSucceeded {
+			outputs[event.NodeId] = string(event.Output)
+		}
+	}
+	for _, id := range []string{"node1", "node2", "node3"} {
+		assert.Equal(t, []flow.NodeState{flow.NodeRunning, flow.NodeSucceeded}, states[id])
+	}
+	assert.Equal(t, `{"out_node1":4}`, outputs["node1"])
+	assert.Equal(t, `{"sum":10}`, outputs["node3"])
+
+	result, err := executor.Result(runID)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"sum":10}`, string(result.Output))
+
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("broken").Modify(func(data []byte) ([]byte, error) {
+		return nil, fmt.Errorf("backend down")
+	})
+	dag.Node("after").Modify(func(data []byte) ([]byte, error) {
+		return data, nil
+	})
+	dag.Edge("broken", "after")
+	executor = flow.FlowExecutor{Flow: workflow}
+	var failed *flow.Event
+	_, err = executor.ExecuteWithEvents([]byte(`{}`), func(event *flow.Event) {
+		if event.State == flow.NodeFailed {
+			failed = event
+		}
+	})
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, "broken", failed.NodeId)
+	assert.Contains(t, failed.Err.Error(), "backend down")
+}
+
+type recorder struct {
+	flow.BaseListener
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *recorder) record(call string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *recorder) OnRunStart(run *flow.RunInfo) {
+	r.record(fmt.Sprintf("run start %d", run.InputSize))
+}
+
+func (r *recorder) OnOperationEnd(operation *flow.OperationInfo) {
+	r.record(fmt.Sprintf("operation %s %s", operation.NodeId, operation.OperationId))
+}
+
+func (r *recorder) OnNodeEnd(node *flow.NodeInfo) {
+	r.record(fmt.Sprintf("node %s %d %v", node.NodeId, node.OutputSize, node.Err))
+}
+
+func (r *recorder) OnRunEnd(run *flow.RunInfo) {
+	r.record(fmt.Sprintf("run end %d %v", run.OutputSize, run.Err))
+}
+
+func TestListeners(t *testing.T) {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("first").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"a":1}`), nil
+	}).Out("a")
+	dag.Node("second").Modify(func(data []byte) ([]byte, error) {
+		return data, nil
+	}).In("a").Out("a")
+	dag.Edge("first", "second")
+
+	listener := &recorder{}
+	executor := flow.FlowExecutor{Flow: workflow, Listeners: []flow.Listener{listener}}
+	_, err := executor.ExecuteFlow([]byte(`{}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, []string{
+		"run start 2",
+		"operation first modifier",
+		"node first 7 <nil>",
+		"operation second modifier",
+		"node second 7 <nil>",
+		"run end 7 <nil>",
+	}, listener.calls)
+}
+
+type logger struct {
+	recorder
+}
+
+func (l *logger) OnLog(log *flow.LogInfo) {
+	l.record(fmt.Sprintf("log %s %s", log.NodeId, log.Message))
+}
+
+func TestLogger(t *testing.T) {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("first").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"a":1}`), nil
+	}).Out("a")
+	dag.Node("second").Modify(echo).In("a").Out("b")
+	dag.EdgeWhen("first", "second", "a > 1")
+
+	listener := &logger{}
+	executor := flow.FlowExecutor{Flow: workflow, Listeners: []flow.Listener{listener}}
+	_, err := executor.ExecuteFlow([]byte(`{}`))
+	assert.Equal(t, nil, err)
+	assert.Contains(t, listener.calls, "log second Skipping node `second`")
+}
+
+func TestInterceptors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fmt.Sprintf(`{"auth":%q}`, r.Header.Get("Authorization"))))
+	}))
+	defer server.Close()
+
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("fetch").Request(server.URL).Out("auth")
+	dag.Node("cached").Modify(func(data []byte) ([]byte, error) {
+		return nil, fmt.Errorf("never called")
+	}).Intercept(func(ctx context.Context, call *flow.OperationCall, data []byte, next flow.Invoker) ([]byte, error) {
+		return []byte(`{"hit":true}`), nil
+	}).Out("hit")
+
+	calls := make(chan string, 2)
+	executor := flow.FlowExecutor{Flow: workflow}
+	executor.Use(func(ctx context.Context, call *flow.OperationCall, data []byte, next flow.Invoker) ([]byte, error) {
+		calls <- call.NodeId
+		return next(flow.WithHeader(ctx, "Authorization", "Bearer token"), data)
+	})
+	result, err := executor.ExecuteFlow([]byte(`{}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"auth":"Bearer token","hit":true}`, string(result))
+	assert.Equal(t, 2, len(calls))
+
+	workflow = new(flow.Workflow)
+	workflow.NewDag().Node("broken").Modify(func(data []byte) ([]byte, error) {
+		return nil, fmt.Errorf("backend down")
+	})
+	executor = flow.FlowExecutor{Flow: workflow}
+	executor.Use(func(ctx context.Context, call *flow.OperationCall, data []byte, next flow.Invoker) ([]byte, error) {
+		result, err := next(ctx, data)
+		if err != nil {
+			return nil, fmt.Errorf("node %s: %v", call.NodeId, err)
+		}
+		return result, nil
+	})
+	_, err = executor.ExecuteFlow([]byte(`{}`))
+	assert.EqualError(t, err, "[node broken: error: Failed at modifier, backend down,]")
+}
+
+func TestPlan(t *testing.T) {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	for _, id := range []string{"node1", "node2"} {
+		dag.Node(id).Modify(echo).In("in_foo").Out("out_" + id)
+		dag.Edge(id, "node3")
+	}
+	dag.Node("node3").Modify(echo).In("out_node1", "out_node2").Out("sum")
+	dag.Node("notify").Apply("notifier", flow.Query("channel", "mail")).In("sum", "in_foo")
+	dag.Edge("node3", "notify")
+
+	plan, err := workflow.Plan()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(plan.Stages))
+	assert.Equal(t, "node3", plan.Stages[1][0].NodeId)
+	assert.Equal(t, []*flow.PlanInput{{Key: "sum", Source: "node3"}, {Key: "in_foo"}}, plan.Stages[2][0].Inputs)
+
+	target := `stage 0
+  node node1
+    operation modifier {hasFailureHandler=false hasResponseHandler=false isFunction=false isHttpRequest=false isMod=true}
+    in in_foo <- request
+    out out_node1
+    next node3
+  node node2
+    operation modifier {hasFailureHandler=false hasResponseHandler=false isFunction=false isHttpRequest=false isMod=true}
+    in in_foo <- request
+    out out_node2
+    next node3
+stage 1
+  node node3
+    operation modifier {hasFailureHandler=false hasResponseHandler=false isFunction=false isHttpRequest=false isMod=true}
+    in out_node1 <- node1
+    in out_node2 <- node2
+    out sum
+    next notify
+stage 2
+  node notify
+    operation notifier http://gateway:8080/function/notifier?channel-mail {hasFailureHandler=false hasResponseHandler=false isFunction=true isHttpRequest=false isMod=false}
+    in sum <- node3
+    in in_foo <- request
+`
+	os.Setenv("gateway", "gateway:8080")
+	defer os.Unsetenv("gateway")
+	plan, _ = workflow.Plan()
+	assert.Equal(t, target, plan.String())
+}
+
+func TestValidate(t *testing.T) {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("a").Modify(echo)
+	dag.Node("b").Modify(echo)
+	dag.Edge("a", "b")
+	dag.Edge("b", "a")
+	assert.EqualError(t, workflow.Validate(), "workflow has 1 problem(s): cycle: cycle a -> b -> a")
+
+	// checks not needing a compiled flow still run past the cycle
+	dag.Node("c").In("missing")
+	dag.Edge("b", "c")
+	assert.EqualError(t, workflow.Validate(), "workflow has 3 problem(s): "+
+		"no-operations: node c has no operations; "+
+		"cycle: cycle a -> b -> a; "+
+		`unsatisfied-input: node c reads "missing" which no upstream node outputs and is not a workflow input`)
+
+	workflow = new(flow.Workflow)
+	dag = workflow.NewDag()
+	dag.Node("fetch").Modify(echo).In("id").Out("user")
+	dag.Node("audit").Modify(echo).In("id").Out("user", "logged")
+	dag.Node("empty").In("user")
+	dag.Node("gated").Modify(echo).In("user", "token").Out("result")
+	dag.Edge("fetch", "empty")
+	dag.Edge("fetch", "missing")
+	dag.EdgeWhen("empty", "gated", "score > 1")
+	workflow.Inputs("id")
+
+	err := workflow.Validate()
+	var validationErr *flow.ValidationError
+	assert.True(t, errors.As(err, &validationErr))
+	messages := make([]string, 0)
+	for _, diag := range validationErr.Diagnostics {
+		messages = append(messages, diag.String())
+	}
+	assert.Equal(t, []string{
+		"no-operations: node empty has no operations",
+		"undeclared-node: edge fetch -> missing refers to undeclared node missing",
+		`unsatisfied-input: node gated reads "token" which no upstream node outputs and is not a workflow input`,
+		`duplicate-output: nodes fetch and audit both output "user" and may run in parallel`,
+		`unsatisfied-input: condition of edge empty -> gated reads "score" which empty does not output`,
+		"unreachable: node gated can never run, too few of its inbound edges can be followed",
+		"dead-end: outputs of node audit are never read and never reach the result",
+	}, messages)
+
+	assert.Equal(t, nil, buildSumFlow().Inputs("in_foo").Validate())
+
+	// the branches of a choice node never run together
+	workflow = new(flow.Workflow)
+	dag = workflow.NewDag()
+	dag.Node("route").In("kind").SwitchOn("kind").
+		Case("card", "card").
+		Case("bank", "bank").
+		Default("manual")
+	dag.Node("card").Modify(echo).Out("paid_by")
+	dag.Node("bank").Modify(echo).Out("paid_by")
+	dag.Node("manual").Modify(echo).Out("paid_by")
+	assert.Equal(t, nil, workflow.Inputs("kind").Validate())
+
+	workflow = new(flow.Workflow)
+	dag = workflow.NewDag()
+	dag.Node("route").In("kind").SwitchOn("kind").
+		Case("card", "card").
+		Case("bank", "bank").
+		Default("manual")
+	dag.Node("card").Modify(echo).Out("card")
+	dag.Node("bank").Modify(echo).Out("bank")
+	dag.Node("manual").Modify(echo).Out("pending")
+	dag.Node("charge").Modify(echo).In("card").Out("paid_by")
+	dag.Node("transfer").Modify(echo).In("bank").Out("paid_by")
+	dag.Node("review").Modify(echo).In("pending").Out("paid_by")
+	dag.Edge("card", "charge")
+	dag.Edge("bank", "transfer")
+	dag.Edge("manual", "review")
+	assert.Equal(t, nil, workflow.Inputs("kind").Validate())
+
+	dag.Node("audit").Modify(echo).Out("paid_by")
+	assert.EqualError(t, workflow.Validate(), "workflow has 4 problem(s): "+
+		`duplicate-output: nodes charge and audit both output "paid_by" and may run in parallel; `+
+		`duplicate-output: nodes transfer and audit both output "paid_by" and may run in parallel; `+
+		`duplicate-output: nodes review and audit both output "paid_by" and may run in parallel; `+
+		"dead-end: outputs of node audit are never read and never reach the result")
+}
+
+func TestAutoWire(t *testing.T) {
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("sum").Modify(func(data []byte) ([]byte, error) {
+		result, _ := simplejson.NewJson(data)
+		a, _ := result.Get("a").Int()
+		b, _ := result.Get("b").Int()
+		return []byte(fmt.Sprintf(`{"sum":%d}`, a+b)), nil
+	}).In("a", "b").Out("sum")
+	dag.Node("a").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"a":1}`), nil
+	}).In("seed").Out("a")
+	dag.Node("b").Modify(func(data []byte) ([]byte, error) {
+		return []byte(`{"b":2}`), nil
+	}).In("a").Out("b")
+	dag.Node("report").Modify(echo).In("a", "sum").Out("sum")
+	dag.Edge("a", "b")
+	assert.Equal(t, nil, workflow.AutoWire())
+
+	plan, _ := workflow.Plan()
+	assert.Equal(t, 4, len(plan.Stages))
+	executor := flow.FlowExecutor{Flow: workflow}
+	result, err := executor.ExecuteFlow([]byte(`{}`))
+	assert.Equal(t, nil, err)
+	assert.Equal(t, `{"sum":3}`, string(result))
+
+	workflow = new(flow.Workflow)
+	dag = workflow.NewDag()
+	dag.Node("cache").Modify(echo).Out("user")
+	dag.Node("db").Modify(echo).Out("user")
+	dag.Node("greet").Modify(echo).In("user")
+	assert.EqualError(t, workflow.AutoWire(), `auto wiring failed: "user" read by greet is produced by cache, db`)
+
+	dag.Edge("db", "greet")
+	assert.Equal(t, nil, workflow.AutoWire())
+
+	workflow = new(flow.Workflow)
+	dag = workflow.NewDag()
+	dag.Node("a").Modify(echo).In("y").Out("x")
+	dag.Node("b").Modify(echo).In("x").Out("y")
+	assert.EqualError(t, workflow.AutoWire(), "auto wiring failed: wiring creates cycle a -> b -> a")
+	assert.Equal(t, nil, workflow.IsLegal())
+}
+
+func TestInterceptorsCoverCompensationsAndSubFlows(t *testing.T) {
+	child := new(flow.Workflow)
+	child.NewDag().Node("inner").Modify(echo)
+
+	workflow := new(flow.Workflow)
+	dag := workflow.NewDag()
+	dag.Node("a").SubFlow(child).CompensateModify(echo)
+	dag.Node("b").Modify(func(data []byte) ([]byte, error) {
+		return nil, fmt.Errorf("backend down")
+	})
+	dag.Edge("a", "b")
+
+	var mu sync.Mutex
+	calls := make([]string, 0)
+	executor := flow.FlowExecutor{Flow: workflow}
+	executor.Use(func(ctx context.Context, call *flow.OperationCall, data []byte, next flow.Invoker) ([]byte, error) {
+		mu.Lock()
+		calls = append(calls, fmt.Sprintf("%s:%s:%v", call.NodeId, call.Operation.GetId(), call.Compensation))
+		mu.Unlock()
+		return next(ctx, data)
+	})
+	_, err := executor.ExecuteFlow([]byte(`{}`))
+	assert.Contains(t, err.Error(), "compensated nodes: [a]")
+	assert.Equal(t, []string{
+		"a:subflow:false",
+		"inner:modifier:false",
+		"b:modifier:false",
+		"a:modifier:true",
+	}, calls)
+}